@@ -0,0 +1,1156 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// loadConfigFile reads a YAML or TOML file whose keys mirror the environment
+// variable names. Only flat key/value pairs are supported:
+//
+//	# YAML
+//	COLLECT_INFLUXDB_HOSTNAME: https://localhost:8086/
+//	COLLECT_STRICTIDM: true
+//
+//	# TOML
+//	COLLECT_INFLUXDB_HOSTNAME = "https://localhost:8086/"
+//	COLLECT_STRICTIDM = true
+//
+// Each key is exported to the environment unless it is already defined, so
+// environment variables take precedence. Flags only check whether a variable
+// is defined, so their values are parsed with strconv.ParseBool and false
+// leaves the flag undefined. Nested sections, such as TOML tables or indented
+// YAML mappings, are rejected.
+func loadConfigFile(filename string) error {
+	sep := ":"
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		sep = "="
+	default:
+		return xerrors.Errorf("unknown config file type %q, expected .yaml, .yml or .toml", filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return xerrors.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	// Parse the whole file before exporting anything, so a bad line doesn't
+	// leave the environment partially configured.
+	var keys, vals []string
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		indented := strings.TrimLeft(scanner.Text(), " \t") != scanner.Text()
+		if indented || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "- ") {
+			return xerrors.Errorf("%s:%d: nested sections are not supported, keys must be environment variable names at the top level", filename, lineNum)
+		}
+
+		idx := strings.Index(line, sep)
+		if idx <= 0 {
+			return xerrors.Errorf("%s:%d: expected key%s value", filename, lineNum, sep)
+		}
+
+		key := strings.TrimSpace(line[:idx])
+		val, err := parseConfigValue(line[idx+1:])
+		if err != nil {
+			return xerrors.Errorf("%s:%d: %w", filename, lineNum, err)
+		}
+
+		if configFlags[key] {
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return xerrors.Errorf("%s:%d: %s: expected true or false, got %q", filename, lineNum, key, val)
+			}
+			if !enabled {
+				continue
+			}
+		}
+
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return xerrors.Errorf("scanner.Err: %w", err)
+	}
+
+	for idx, key := range keys {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+
+		if err := os.Setenv(key, vals[idx]); err != nil {
+			return xerrors.Errorf("os.Setenv: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// configFlags are the variables which are enabled by being defined, whatever
+// their value.
+var configFlags = map[string]bool{
+	"COLLECT_CHANNEL_TAG":                   true,
+	"COLLECT_DECODE_ENDPOINT_TYPE":          true,
+	"COLLECT_DEDUP_CUMULATIVE":              true,
+	"COLLECT_DETECT_RESET":                  true,
+	"COLLECT_DISABLE_DEDUP":                 true,
+	"COLLECT_DROP_LATE":                     true,
+	"COLLECT_DROP_ZERO":                     true,
+	"COLLECT_EMIT_DELTA":                    true,
+	"COLLECT_HEARTBEAT":                     true,
+	"COLLECT_IDM_CHANGED_ONLY":              true,
+	"COLLECT_IDM_EXTENDED":                  true,
+	"COLLECT_IDM_RATE":                      true,
+	"COLLECT_INCLUDE_RAW":                   true,
+	"COLLECT_INFLUXDB_ASYNC":                true,
+	"COLLECT_INFLUXDB_CREATE_BUCKET":        true,
+	"COLLECT_INFLUXDB_DRYRUN":               true,
+	"COLLECT_INFLUXDB_INSECURE_SKIP_VERIFY": true,
+	"COLLECT_INPUT_GZIP":                    true,
+	"COLLECT_MEASUREMENT_BY_TYPE":           true,
+	"COLLECT_MONOTONIC":                     true,
+	"COLLECT_NDJSON_DAILY":                  true,
+	"COLLECT_R900_ALERTS":                   true,
+	"COLLECT_R900_RAW":                      true,
+	"COLLECT_RAW_LOG_DAILY":                 true,
+	"COLLECT_SELFTEST":                      true,
+	"COLLECT_STATE_MEMORY":                  true,
+	"COLLECT_STATE_NOSYNC":                  true,
+	"COLLECT_STATS_RESET":                   true,
+	"COLLECT_STRICTIDM":                     true,
+	"COLLECT_STRICT_FIELDS":                 true,
+	"COLLECT_TRACK_FIRMWARE":                true,
+}
+
+// parseConfigValue unquotes a value and strips trailing comments.
+func parseConfigValue(val string) (string, error) {
+	val = strings.TrimSpace(val)
+
+	switch {
+	case strings.HasPrefix(val, `"`):
+		end := strings.LastIndex(val, `"`)
+		if end == 0 {
+			return "", xerrors.New("unterminated string")
+		}
+		return strconv.Unquote(val[:end+1])
+	case strings.HasPrefix(val, "'"):
+		end := strings.LastIndex(val, "'")
+		if end == 0 {
+			return "", xerrors.New("unterminated string")
+		}
+		return val[1:end], nil
+	}
+
+	if idx := strings.Index(val, " #"); idx >= 0 {
+		val = val[:idx]
+	}
+
+	return strings.TrimSpace(val), nil
+}
+
+// Config is the collector's configuration. Each field is populated from the
+// environment variable noted.
+type Config struct {
+	DryRun       bool // COLLECT_INFLUXDB_DRYRUN
+	StrictIDM    bool // COLLECT_STRICTIDM
+	StrictFields bool // COLLECT_STRICT_FIELDS
+
+	DedupCumulative bool // COLLECT_DEDUP_CUMULATIVE
+	DisableDedup    bool // COLLECT_DISABLE_DEDUP
+
+	DupWindow   time.Duration // COLLECT_DUP_WINDOW
+	DedupBucket time.Duration // COLLECT_DEDUP_BUCKET
+
+	StateNoSync bool // COLLECT_STATE_NOSYNC
+	StateMemory bool // COLLECT_STATE_MEMORY
+
+	IDMInterval time.Duration // COLLECT_IDM_INTERVAL
+	IDMRate     bool          // COLLECT_IDM_RATE
+	IDMExtended bool          // COLLECT_IDM_EXTENDED
+
+	IDMChangedOnly bool // COLLECT_IDM_CHANGED_ONLY
+
+	TrackFirmware bool // COLLECT_TRACK_FIRMWARE
+
+	RateSmoothing float64 // COLLECT_RATE_SMOOTHING
+	DetectReset   bool    // COLLECT_DETECT_RESET
+	Monotonic     bool    // COLLECT_MONOTONIC
+	DropLate      bool    // COLLECT_DROP_LATE
+	DropZero      bool    // COLLECT_DROP_ZERO
+	EmitDelta     bool    // COLLECT_EMIT_DELTA
+
+	KnownMeters map[uint32]bool // COLLECT_KNOWN_METERS
+	MaxSeries   int             // COLLECT_MAX_SERIES
+
+	// MinIntervals maps each protocol to the minimum time between written
+	// messages per meter, from COLLECT_MIN_INTERVAL and
+	// COLLECT_MIN_INTERVAL_<PROTOCOL>.
+	MinIntervals map[string]time.Duration
+
+	// Enabled is whether messages of each protocol are written, from
+	// COLLECT_ENABLE_<PROTOCOL>.
+	Enabled map[string]bool
+
+	InputFormat  string         // COLLECT_INPUT_FORMAT
+	InputGzip    bool           // COLLECT_INPUT_GZIP
+	MaxLineBytes int            // COLLECT_MAX_LINE_BYTES
+	Workers      int            // COLLECT_WORKERS
+	ReplaySpeed  float64        // COLLECT_REPLAY_SPEED
+	ListenUnix   string         // COLLECT_LISTEN_UNIX
+	Output       string         // COLLECT_OUTPUT
+	TimeLocation *time.Location // COLLECT_TIMEZONE
+	Timestamp    string         // COLLECT_TIMESTAMP
+
+	RawLog        string // COLLECT_RAW_LOG
+	RawLogMaxSize int64  // COLLECT_RAW_LOG_MAX_SIZE
+	RawLogDaily   bool   // COLLECT_RAW_LOG_DAILY
+
+	NDJSONPath    string // COLLECT_NDJSON_PATH
+	NDJSONMaxSize int64  // COLLECT_NDJSON_MAX_SIZE
+	NDJSONDaily   bool   // COLLECT_NDJSON_DAILY
+
+	// Sources maps each source tag to the input it is read from, from
+	// COLLECT_SOURCES.
+	Sources map[string]string
+
+	MQTTURL       string // COLLECT_MQTT_URL
+	MQTTDiscovery string // COLLECT_MQTT_HA_DISCOVERY
+	PayloadFormat string // COLLECT_PAYLOAD_FORMAT
+
+	GraphiteAddr   string // COLLECT_GRAPHITE_ADDR
+	GraphitePrefix string // COLLECT_GRAPHITE_PREFIX
+
+	TimestreamDatabase string // COLLECT_TIMESTREAM_DATABASE
+	TimestreamTable    string // COLLECT_TIMESTREAM_TABLE
+	TimestreamRegion   string // COLLECT_TIMESTREAM_REGION
+	TimestreamEndpoint string // COLLECT_TIMESTREAM_ENDPOINT
+
+	// AWSCredentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN.
+	AWSCredentials awsCredentials
+
+	NATSURL      string        // COLLECT_NATS_URL
+	NATSStream   string        // COLLECT_NATS_STREAM
+	UDPAddr      string        // COLLECT_INFLUXDB_UDP
+	Hostname     string        // COLLECT_INFLUXDB_HOSTNAME
+	Token        string        // COLLECT_INFLUXDB_TOKEN
+	Org          string        // COLLECT_INFLUXDB_ORG
+	Bucket       string        // COLLECT_INFLUXDB_BUCKET
+	ClientCert   string        // COLLECT_INFLUXDB_CLIENT_CERT
+	ClientKey    string        // COLLECT_INFLUXDB_CLIENT_KEY
+	CACert       string        // COLLECT_INFLUXDB_CA_CERT
+	Proxy        string        // COLLECT_INFLUXDB_PROXY
+	UserAgent    string        // COLLECT_INFLUXDB_USER_AGENT
+	CreateBucket bool          // COLLECT_INFLUXDB_CREATE_BUCKET
+	Retention    time.Duration // COLLECT_INFLUXDB_RETENTION
+	WriteTimeout time.Duration // COLLECT_INFLUXDB_WRITE_TIMEOUT
+	Async        bool          // COLLECT_INFLUXDB_ASYNC
+
+	InsecureSkipVerify bool // COLLECT_INFLUXDB_INSECURE_SKIP_VERIFY
+
+	// Measurements maps each protocol to its measurement, from
+	// COLLECT_INFLUXDB_MEASUREMENT and COLLECT_INFLUXDB_MEASUREMENT_<PROTOCOL>.
+	Measurements map[string]string
+	StaticTags   map[string]string // COLLECT_STATIC_TAGS
+	FieldMap     map[string]string // COLLECT_FIELD_MAP
+	JSONKeys     map[string]string // COLLECT_JSON_KEYS
+	Units        Units             // COLLECT_UNITS
+	IDRanges     []IDRange         // COLLECT_ID_RANGES
+	NumericType  string            // COLLECT_NUMERIC_TYPE
+
+	// MsgTypeNames maps the cumulative and differential msg_type tag values
+	// to those written, from COLLECT_MSGTYPE_<TYPE>.
+	MsgTypeNames map[string]string
+
+	DecodeEndpointType bool // COLLECT_DECODE_ENDPOINT_TYPE
+	MeasurementByType  bool // COLLECT_MEASUREMENT_BY_TYPE
+	ChannelTag         bool // COLLECT_CHANNEL_TAG
+	IncludeRaw         bool // COLLECT_INCLUDE_RAW
+
+	R900Raw            bool    // COLLECT_R900_RAW
+	R900Alerts         bool    // COLLECT_R900_ALERTS
+	R900GallonsPerUnit float64 // COLLECT_R900_GALLONS_PER_UNIT
+
+	Heartbeat        bool          // COLLECT_HEARTBEAT
+	StaleMeasurement string        // COLLECT_STALE_MEASUREMENT
+	StaleInterval    time.Duration // COLLECT_STALE_INTERVAL
+
+	KeepaliveInterval time.Duration // COLLECT_KEEPALIVE_INTERVAL
+	BatchWindow       time.Duration // COLLECT_BATCH_WINDOW
+
+	WriteRate  float64 // COLLECT_WRITE_RATE
+	WriteQueue int     // COLLECT_WRITE_QUEUE
+
+	WALMax int // COLLECT_WAL_MAX
+
+	ShutdownTimeout time.Duration // COLLECT_SHUTDOWN_TIMEOUT
+	IdleTimeout     time.Duration // COLLECT_IDLE_TIMEOUT
+
+	WebhookURL      string        // COLLECT_WEBHOOK_URL
+	WebhookInterval time.Duration // COLLECT_WEBHOOK_INTERVAL
+
+	StatsInterval time.Duration // COLLECT_STATS_INTERVAL
+	StatsReset    bool          // COLLECT_STATS_RESET
+}
+
+// NewConfigFromEnv validates and parses the configuration from the
+// environment.
+func NewConfigFromEnv() (cfg Config, err error) {
+	if err := loadSecretFiles(); err != nil {
+		return cfg, xerrors.Errorf("loadSecretFiles: %w", err)
+	}
+
+	_, cfg.DryRun = os.LookupEnv("COLLECT_INFLUXDB_DRYRUN")
+
+	// COLLECT_STRICTIDM limits which endpoint types may be decoded between
+	// IDM and NetIDM. In the wild, type 7 should be standard IDM and type 8
+	// should be NetIDM. Both messages have the same preamble and checksum, so
+	// they are picked up by both decoders, but have different internal field
+	// layout.
+	_, cfg.StrictIDM = os.LookupEnv("COLLECT_STRICTIDM")
+	_, cfg.StrictFields = os.LookupEnv("COLLECT_STRICT_FIELDS")
+	_, cfg.DedupCumulative = os.LookupEnv("COLLECT_DEDUP_CUMULATIVE")
+	_, cfg.DisableDedup = os.LookupEnv("COLLECT_DISABLE_DEDUP")
+	_, cfg.StateNoSync = os.LookupEnv("COLLECT_STATE_NOSYNC")
+	_, cfg.StateMemory = os.LookupEnv("COLLECT_STATE_MEMORY")
+
+	cfg.IDMInterval = 5 * time.Minute
+	if val, ok := os.LookupEnv("COLLECT_IDM_INTERVAL"); ok {
+		cfg.IDMInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_IDM_INTERVAL: %w", err)
+		}
+		if cfg.IDMInterval <= 0 {
+			return cfg, xerrors.New("COLLECT_IDM_INTERVAL: must be positive")
+		}
+	}
+	_, cfg.IDMRate = os.LookupEnv("COLLECT_IDM_RATE")
+	_, cfg.IDMExtended = os.LookupEnv("COLLECT_IDM_EXTENDED")
+	_, cfg.IDMChangedOnly = os.LookupEnv("COLLECT_IDM_CHANGED_ONLY")
+	_, cfg.TrackFirmware = os.LookupEnv("COLLECT_TRACK_FIRMWARE")
+
+	if val, ok := os.LookupEnv("COLLECT_DUP_WINDOW"); ok {
+		cfg.DupWindow, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_DUP_WINDOW: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_DEDUP_BUCKET"); ok {
+		cfg.DedupBucket, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_DEDUP_BUCKET: %w", err)
+		}
+		if cfg.DedupBucket <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_DEDUP_BUCKET: must be positive")
+		}
+	}
+
+	_, cfg.DetectReset = os.LookupEnv("COLLECT_DETECT_RESET")
+	_, cfg.Monotonic = os.LookupEnv("COLLECT_MONOTONIC")
+	_, cfg.DropLate = os.LookupEnv("COLLECT_DROP_LATE")
+	_, cfg.DropZero = os.LookupEnv("COLLECT_DROP_ZERO")
+	_, cfg.EmitDelta = os.LookupEnv("COLLECT_EMIT_DELTA")
+
+	if val, ok := os.LookupEnv("COLLECT_RATE_SMOOTHING"); ok {
+		cfg.RateSmoothing, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_RATE_SMOOTHING: %w", err)
+		}
+		if cfg.RateSmoothing <= 0 || cfg.RateSmoothing > 1 {
+			return cfg, xerrors.New("COLLECT_RATE_SMOOTHING: must be greater than 0 and at most 1")
+		}
+	}
+
+	cfg.InputFormat = os.Getenv("COLLECT_INPUT_FORMAT")
+	switch cfg.InputFormat {
+	case "":
+		cfg.InputFormat = "json"
+	case "json", "csv":
+	default:
+		return cfg, xerrors.Errorf("COLLECT_INPUT_FORMAT: unknown format %q", cfg.InputFormat)
+	}
+
+	// COLLECT_INFLUXDB_UDP implies the udp output.
+	cfg.UDPAddr = os.Getenv("COLLECT_INFLUXDB_UDP")
+
+	// COLLECT_NATS_URL implies the nats output.
+	cfg.NATSURL = os.Getenv("COLLECT_NATS_URL")
+	cfg.NATSStream = os.Getenv("COLLECT_NATS_STREAM")
+
+	// COLLECT_MQTT_URL implies the mqtt output.
+	cfg.MQTTURL = os.Getenv("COLLECT_MQTT_URL")
+	cfg.MQTTDiscovery = os.Getenv("COLLECT_MQTT_HA_DISCOVERY")
+
+	// COLLECT_GRAPHITE_ADDR implies the graphite output.
+	cfg.GraphiteAddr = os.Getenv("COLLECT_GRAPHITE_ADDR")
+	cfg.GraphitePrefix = defaultGraphitePrefix
+	if val, ok := os.LookupEnv("COLLECT_GRAPHITE_PREFIX"); ok {
+		cfg.GraphitePrefix = val
+	}
+
+	// COLLECT_TIMESTREAM_DATABASE implies the timestream output. The region
+	// falls back to those used by the AWS cli.
+	cfg.TimestreamDatabase = os.Getenv("COLLECT_TIMESTREAM_DATABASE")
+	cfg.TimestreamTable = os.Getenv("COLLECT_TIMESTREAM_TABLE")
+	cfg.TimestreamEndpoint = os.Getenv("COLLECT_TIMESTREAM_ENDPOINT")
+	for _, name := range []string{"COLLECT_TIMESTREAM_REGION", "AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if val := os.Getenv(name); val != "" {
+			cfg.TimestreamRegion = val
+			break
+		}
+	}
+	cfg.AWSCredentials = awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	cfg.PayloadFormat = "json"
+	if val, ok := os.LookupEnv("COLLECT_PAYLOAD_FORMAT"); ok {
+		switch val {
+		case "json", "msgpack":
+			cfg.PayloadFormat = val
+		default:
+			return cfg, xerrors.Errorf("COLLECT_PAYLOAD_FORMAT: unknown format %q, expected json or msgpack", val)
+		}
+	}
+	// Home Assistant reads the sensor state from json.
+	if cfg.PayloadFormat == "msgpack" && cfg.MQTTDiscovery != "" {
+		return cfg, xerrors.New("COLLECT_PAYLOAD_FORMAT: msgpack cannot be combined with COLLECT_MQTT_HA_DISCOVERY")
+	}
+
+	cfg.ListenUnix = os.Getenv("COLLECT_LISTEN_UNIX")
+
+	cfg.MaxLineBytes = defaultMaxLineBytes
+	if val, ok := os.LookupEnv("COLLECT_MAX_LINE_BYTES"); ok {
+		cfg.MaxLineBytes, err = strconv.Atoi(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_MAX_LINE_BYTES: %w", err)
+		}
+		if cfg.MaxLineBytes <= 0 {
+			return cfg, xerrors.New("COLLECT_MAX_LINE_BYTES: must be positive")
+		}
+	}
+
+	cfg.Workers = 1
+	if val, ok := os.LookupEnv("COLLECT_WORKERS"); ok {
+		cfg.Workers, err = strconv.Atoi(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_WORKERS: %w", err)
+		}
+		if cfg.Workers <= 0 {
+			return cfg, xerrors.New("COLLECT_WORKERS: must be positive")
+		}
+	}
+
+	// Zero replays as fast as possible.
+	if val, ok := os.LookupEnv("COLLECT_REPLAY_SPEED"); ok && val != "max" {
+		cfg.ReplaySpeed, err = strconv.ParseFloat(strings.TrimSuffix(val, "x"), 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_REPLAY_SPEED: %w", err)
+		}
+		if cfg.ReplaySpeed <= 0 {
+			return cfg, xerrors.New("COLLECT_REPLAY_SPEED: must be positive or max")
+		}
+	}
+
+	cfg.RawLog = os.Getenv("COLLECT_RAW_LOG")
+	_, cfg.RawLogDaily = os.LookupEnv("COLLECT_RAW_LOG_DAILY")
+	if val, ok := os.LookupEnv("COLLECT_RAW_LOG_MAX_SIZE"); ok {
+		cfg.RawLogMaxSize, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_RAW_LOG_MAX_SIZE: %w", err)
+		}
+	}
+
+	cfg.NDJSONPath = os.Getenv("COLLECT_NDJSON_PATH")
+	_, cfg.NDJSONDaily = os.LookupEnv("COLLECT_NDJSON_DAILY")
+	if val, ok := os.LookupEnv("COLLECT_NDJSON_MAX_SIZE"); ok {
+		cfg.NDJSONMaxSize, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_NDJSON_MAX_SIZE: %w", err)
+		}
+	}
+
+	cfg.Sources = map[string]string{}
+	if val, ok := os.LookupEnv("COLLECT_SOURCES"); ok {
+		cfg.Sources, err = parseKeyValues(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_SOURCES: %w", err)
+		}
+		if cfg.ListenUnix != "" {
+			return cfg, xerrors.New("COLLECT_SOURCES: cannot be combined with COLLECT_LISTEN_UNIX")
+		}
+		for source := range cfg.Sources {
+			if err := checkLineProtocol(source); err != nil {
+				return cfg, xerrors.Errorf("COLLECT_SOURCES: %w", err)
+			}
+		}
+	}
+
+	_, cfg.InputGzip = os.LookupEnv("COLLECT_INPUT_GZIP")
+	if cfg.InputGzip && (cfg.ListenUnix != "" || len(cfg.Sources) > 0) {
+		return cfg, xerrors.New("COLLECT_INPUT_GZIP: only applies to stdin, not COLLECT_LISTEN_UNIX or COLLECT_SOURCES")
+	}
+
+	cfg.Output = os.Getenv("COLLECT_OUTPUT")
+	switch {
+	case cfg.Output == "" && cfg.UDPAddr != "":
+		cfg.Output = "udp"
+	case cfg.Output == "" && cfg.NATSURL != "":
+		cfg.Output = "nats"
+	case cfg.Output == "" && cfg.MQTTURL != "":
+		cfg.Output = "mqtt"
+	case cfg.Output == "" && cfg.NDJSONPath != "":
+		cfg.Output = "ndjson"
+	case cfg.Output == "" && cfg.GraphiteAddr != "":
+		cfg.Output = "graphite"
+	case cfg.Output == "" && cfg.TimestreamDatabase != "":
+		cfg.Output = "timestream"
+	case cfg.Output == "":
+		cfg.Output = "influxdb"
+	}
+
+	switch cfg.Output {
+	case "influxdb", "stdout":
+	case "udp":
+		if cfg.UDPAddr == "" {
+			return cfg, xerrors.New("COLLECT_OUTPUT: udp requires COLLECT_INFLUXDB_UDP")
+		}
+	case "nats":
+		if cfg.NATSURL == "" {
+			return cfg, xerrors.New("COLLECT_OUTPUT: nats requires COLLECT_NATS_URL")
+		}
+	case "mqtt":
+		if cfg.MQTTURL == "" {
+			return cfg, xerrors.New("COLLECT_OUTPUT: mqtt requires COLLECT_MQTT_URL")
+		}
+	case "ndjson":
+		if cfg.NDJSONPath == "" {
+			return cfg, xerrors.New("COLLECT_OUTPUT: ndjson requires COLLECT_NDJSON_PATH")
+		}
+	case "graphite":
+		if cfg.GraphiteAddr == "" {
+			return cfg, xerrors.New("COLLECT_OUTPUT: graphite requires COLLECT_GRAPHITE_ADDR")
+		}
+	case "timestream":
+		switch {
+		case cfg.TimestreamDatabase == "" || cfg.TimestreamTable == "":
+			return cfg, xerrors.New("COLLECT_OUTPUT: timestream requires COLLECT_TIMESTREAM_DATABASE and COLLECT_TIMESTREAM_TABLE")
+		case cfg.TimestreamRegion == "":
+			return cfg, xerrors.New("COLLECT_OUTPUT: timestream requires COLLECT_TIMESTREAM_REGION or AWS_REGION")
+		case cfg.AWSCredentials.AccessKeyID == "" || cfg.AWSCredentials.SecretAccessKey == "":
+			return cfg, xerrors.New("COLLECT_OUTPUT: timestream requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	default:
+		return cfg, xerrors.Errorf("COLLECT_OUTPUT: unknown output %q", cfg.Output)
+	}
+
+	if problems := validateEnv(cfg.DryRun, cfg.Output == "influxdb"); len(problems) > 0 {
+		return cfg, xerrors.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_TIMEZONE"); ok {
+		cfg.TimeLocation, err = time.LoadLocation(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_TIMEZONE: %w", err)
+		}
+	}
+
+	cfg.Timestamp = "message"
+	if val, ok := os.LookupEnv("COLLECT_TIMESTAMP"); ok {
+		switch val {
+		case "message", "receive":
+			cfg.Timestamp = val
+		default:
+			return cfg, xerrors.Errorf("COLLECT_TIMESTAMP: unknown timestamp source %q, expected message or receive", val)
+		}
+	}
+
+	cfg.Hostname = os.Getenv("COLLECT_INFLUXDB_HOSTNAME")
+	cfg.Token = os.Getenv("COLLECT_INFLUXDB_TOKEN")
+	cfg.Org = os.Getenv("COLLECT_INFLUXDB_ORG")
+	cfg.Bucket = os.Getenv("COLLECT_INFLUXDB_BUCKET")
+	cfg.ClientCert = os.Getenv("COLLECT_INFLUXDB_CLIENT_CERT")
+	cfg.ClientKey = os.Getenv("COLLECT_INFLUXDB_CLIENT_KEY")
+	cfg.CACert = os.Getenv("COLLECT_INFLUXDB_CA_CERT")
+	cfg.Proxy = os.Getenv("COLLECT_INFLUXDB_PROXY")
+
+	cfg.UserAgent = "rtlamr-collect/" + buildVersion()
+	if val, ok := os.LookupEnv("COLLECT_INFLUXDB_USER_AGENT"); ok {
+		cfg.UserAgent = val
+	}
+	_, cfg.InsecureSkipVerify = os.LookupEnv("COLLECT_INFLUXDB_INSECURE_SKIP_VERIFY")
+	_, cfg.CreateBucket = os.LookupEnv("COLLECT_INFLUXDB_CREATE_BUCKET")
+
+	if val, ok := os.LookupEnv("COLLECT_INFLUXDB_RETENTION"); ok {
+		cfg.Retention, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_INFLUXDB_RETENTION: %w", err)
+		}
+	}
+
+	_, cfg.Async = os.LookupEnv("COLLECT_INFLUXDB_ASYNC")
+
+	cfg.WriteTimeout = 30 * time.Second
+	if val, ok := os.LookupEnv("COLLECT_INFLUXDB_WRITE_TIMEOUT"); ok {
+		cfg.WriteTimeout, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_INFLUXDB_WRITE_TIMEOUT: %w", err)
+		}
+		if cfg.WriteTimeout <= 0 {
+			return cfg, xerrors.New("COLLECT_INFLUXDB_WRITE_TIMEOUT: must be positive")
+		}
+	}
+
+	measurement := os.Getenv("COLLECT_INFLUXDB_MEASUREMENT")
+	cfg.Measurements = map[string]string{}
+	for protocol, suffix := range protocolSuffix {
+		cfg.Measurements[protocol] = measurement
+		if val, ok := os.LookupEnv("COLLECT_INFLUXDB_MEASUREMENT_" + suffix); ok {
+			cfg.Measurements[protocol] = val
+		}
+		if err := checkLineProtocol(cfg.Measurements[protocol]); err != nil {
+			return cfg, xerrors.Errorf("COLLECT_INFLUXDB_MEASUREMENT: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_KNOWN_METERS"); ok {
+		cfg.KnownMeters, err = parseEndpointIDs(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_KNOWN_METERS: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_MAX_SERIES"); ok {
+		cfg.MaxSeries, err = strconv.Atoi(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_MAX_SERIES: %w", err)
+		}
+	}
+
+	cfg.MinIntervals = map[string]time.Duration{}
+	var minInterval time.Duration
+	if val, ok := os.LookupEnv("COLLECT_MIN_INTERVAL"); ok {
+		minInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_MIN_INTERVAL: %w", err)
+		}
+	}
+	for protocol, suffix := range protocolSuffix {
+		cfg.MinIntervals[protocol] = minInterval
+		if val, ok := os.LookupEnv("COLLECT_MIN_INTERVAL_" + suffix); ok {
+			cfg.MinIntervals[protocol], err = time.ParseDuration(val)
+			if err != nil {
+				return cfg, xerrors.Errorf("COLLECT_MIN_INTERVAL_%s: %w", suffix, err)
+			}
+		}
+	}
+
+	cfg.Enabled = map[string]bool{}
+	for protocol, suffix := range protocolSuffix {
+		cfg.Enabled[protocol] = true
+		if val, ok := os.LookupEnv("COLLECT_ENABLE_" + suffix); ok {
+			cfg.Enabled[protocol], err = strconv.ParseBool(val)
+			if err != nil {
+				return cfg, xerrors.Errorf("COLLECT_ENABLE_%s: %w", suffix, err)
+			}
+		}
+	}
+
+	cfg.StaticTags = map[string]string{}
+	if val, ok := os.LookupEnv("COLLECT_STATIC_TAGS"); ok {
+		cfg.StaticTags, err = parseKeyValues(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_STATIC_TAGS: %w", err)
+		}
+		for key, val := range cfg.StaticTags {
+			// Tags with an empty value are left out of line protocol.
+			if val == "" {
+				return cfg, xerrors.Errorf("COLLECT_STATIC_TAGS: empty value for tag %q", key)
+			}
+			if err := checkLineProtocol(key, val); err != nil {
+				return cfg, xerrors.Errorf("COLLECT_STATIC_TAGS: %w", err)
+			}
+		}
+	}
+
+	cfg.NumericType = os.Getenv("COLLECT_NUMERIC_TYPE")
+	switch cfg.NumericType {
+	case "":
+		cfg.NumericType = "int"
+	case "int", "float":
+	default:
+		return cfg, xerrors.Errorf("COLLECT_NUMERIC_TYPE: unknown type %q, expected int or float", cfg.NumericType)
+	}
+
+	cfg.FieldMap = map[string]string{}
+	if val, ok := os.LookupEnv("COLLECT_FIELD_MAP"); ok {
+		cfg.FieldMap, err = parseKeyValues(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_FIELD_MAP: %w", err)
+		}
+		for _, name := range cfg.FieldMap {
+			if err := checkLineProtocol(name); err != nil {
+				return cfg, xerrors.Errorf("COLLECT_FIELD_MAP: %w", err)
+			}
+		}
+	}
+
+	cfg.MsgTypeNames = map[string]string{}
+	names := map[string]string{}
+	for _, msgType := range []string{"cumulative", "differential"} {
+		key := "COLLECT_MSGTYPE_" + strings.ToUpper(msgType)
+		name := msgType
+		if val, ok := os.LookupEnv(key); ok {
+			if val == "" {
+				return cfg, xerrors.Errorf("%s: must not be empty", key)
+			}
+			if err := checkLineProtocol(val); err != nil {
+				return cfg, xerrors.Errorf("%s: %w", key, err)
+			}
+			cfg.MsgTypeNames[msgType] = val
+			name = val
+		}
+
+		if other, ok := names[name]; ok {
+			return cfg, xerrors.Errorf("%s: %q is already the %s msg_type", key, name, other)
+		}
+		names[name] = msgType
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_JSON_KEYS"); ok {
+		cfg.JSONKeys, err = parseKeyValues(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_JSON_KEYS: %w", err)
+		}
+
+		for name, key := range cfg.JSONKeys {
+			switch name {
+			case "Time", "Type", "Channel", "Message":
+			default:
+				return cfg, xerrors.Errorf("COLLECT_JSON_KEYS: unknown key %q, expected Time, Type, Channel or Message", name)
+			}
+			if key == "" {
+				return cfg, xerrors.Errorf("COLLECT_JSON_KEYS: empty key name for %s", name)
+			}
+		}
+	}
+
+	cfg.Units, err = parseUnits(os.Getenv("COLLECT_UNITS"))
+	if err != nil {
+		return cfg, xerrors.Errorf("COLLECT_UNITS: %w", err)
+	}
+	for _, unit := range cfg.Units.ByID {
+		if err := checkLineProtocol(unit); err != nil {
+			return cfg, xerrors.Errorf("COLLECT_UNITS: %w", err)
+		}
+	}
+	for _, unit := range cfg.Units.ByType {
+		if err := checkLineProtocol(unit); err != nil {
+			return cfg, xerrors.Errorf("COLLECT_UNITS: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_ID_RANGES"); ok {
+		cfg.IDRanges, err = parseIDRanges(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_ID_RANGES: %w", err)
+		}
+		for _, r := range cfg.IDRanges {
+			if err := checkLineProtocol(r.Group); err != nil {
+				return cfg, xerrors.Errorf("COLLECT_ID_RANGES: %w", err)
+			}
+		}
+	}
+
+	_, cfg.DecodeEndpointType = os.LookupEnv("COLLECT_DECODE_ENDPOINT_TYPE")
+	_, cfg.MeasurementByType = os.LookupEnv("COLLECT_MEASUREMENT_BY_TYPE")
+	_, cfg.ChannelTag = os.LookupEnv("COLLECT_CHANNEL_TAG")
+	_, cfg.IncludeRaw = os.LookupEnv("COLLECT_INCLUDE_RAW")
+	_, cfg.R900Raw = os.LookupEnv("COLLECT_R900_RAW")
+	_, cfg.R900Alerts = os.LookupEnv("COLLECT_R900_ALERTS")
+
+	cfg.R900GallonsPerUnit = 1.0
+	if val, ok := os.LookupEnv("COLLECT_R900_GALLONS_PER_UNIT"); ok {
+		cfg.R900GallonsPerUnit, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_R900_GALLONS_PER_UNIT: %w", err)
+		}
+	}
+
+	_, cfg.Heartbeat = os.LookupEnv("COLLECT_HEARTBEAT")
+	cfg.StaleMeasurement = os.Getenv("COLLECT_STALE_MEASUREMENT")
+
+	cfg.StaleInterval = time.Minute
+	if val, ok := os.LookupEnv("COLLECT_STALE_INTERVAL"); ok {
+		cfg.StaleInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_STALE_INTERVAL: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_KEEPALIVE_INTERVAL"); ok {
+		cfg.KeepaliveInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_KEEPALIVE_INTERVAL: %w", err)
+		}
+		if cfg.KeepaliveInterval <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_KEEPALIVE_INTERVAL: must be positive")
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_BATCH_WINDOW"); ok {
+		cfg.BatchWindow, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_BATCH_WINDOW: %w", err)
+		}
+		if cfg.BatchWindow < 0 {
+			return cfg, xerrors.Errorf("COLLECT_BATCH_WINDOW: must not be negative")
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_WRITE_RATE"); ok {
+		cfg.WriteRate, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_WRITE_RATE: %w", err)
+		}
+		if cfg.WriteRate <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_WRITE_RATE: must be positive")
+		}
+	}
+
+	cfg.WriteQueue = 10000
+	if val, ok := os.LookupEnv("COLLECT_WRITE_QUEUE"); ok {
+		cfg.WriteQueue, err = strconv.Atoi(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_WRITE_QUEUE: %w", err)
+		}
+		if cfg.WriteQueue <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_WRITE_QUEUE: must be positive")
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_WAL_MAX"); ok {
+		cfg.WALMax, err = strconv.Atoi(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_WAL_MAX: %w", err)
+		}
+		if cfg.WALMax <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_WAL_MAX: must be positive")
+		}
+		// Both write in the background and only log failures, so points
+		// would be removed from the log before they are written.
+		if cfg.WriteRate > 0 {
+			return cfg, xerrors.New("COLLECT_WAL_MAX: cannot be combined with COLLECT_WRITE_RATE")
+		}
+		if cfg.Async {
+			return cfg, xerrors.New("COLLECT_WAL_MAX: cannot be combined with COLLECT_INFLUXDB_ASYNC")
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_SHUTDOWN_TIMEOUT"); ok {
+		cfg.ShutdownTimeout, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_SHUTDOWN_TIMEOUT: %w", err)
+		}
+		if cfg.ShutdownTimeout <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_SHUTDOWN_TIMEOUT: must be positive")
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_IDLE_TIMEOUT"); ok {
+		cfg.IdleTimeout, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_IDLE_TIMEOUT: %w", err)
+		}
+		if cfg.IdleTimeout <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_IDLE_TIMEOUT: must be positive")
+		}
+	}
+
+	cfg.WebhookURL = os.Getenv("COLLECT_WEBHOOK_URL")
+	cfg.WebhookInterval = 5 * time.Minute
+	if val, ok := os.LookupEnv("COLLECT_WEBHOOK_INTERVAL"); ok {
+		cfg.WebhookInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_WEBHOOK_INTERVAL: %w", err)
+		}
+	}
+
+	if val, ok := os.LookupEnv("COLLECT_STATS_INTERVAL"); ok {
+		cfg.StatsInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return cfg, xerrors.Errorf("COLLECT_STATS_INTERVAL: %w", err)
+		}
+		if cfg.StatsInterval <= 0 {
+			return cfg, xerrors.Errorf("COLLECT_STATS_INTERVAL: must be positive")
+		}
+	}
+	_, cfg.StatsReset = os.LookupEnv("COLLECT_STATS_RESET")
+
+	return cfg, nil
+}
+
+// requiredVars must be defined unless COLLECT_INFLUXDB_DRYRUN is.
+var requiredVars = []string{
+	"COLLECT_INFLUXDB_MEASUREMENT",
+}
+
+// influxVars must also be defined when writing to InfluxDB.
+var influxVars = []string{
+	"COLLECT_INFLUXDB_HOSTNAME",
+	"COLLECT_INFLUXDB_TOKEN",
+	"COLLECT_INFLUXDB_BUCKET",
+}
+
+// pairedVars must be defined together.
+var pairedVars = [][2]string{
+	{"COLLECT_INFLUXDB_CLIENT_CERT", "COLLECT_INFLUXDB_CLIENT_KEY"},
+}
+
+// dependentVars require the second variable when the first is defined.
+var dependentVars = [][2]string{
+	{"COLLECT_INFLUXDB_CREATE_BUCKET", "COLLECT_INFLUXDB_ORG"},
+}
+
+// secretVars have their values masked in the configuration summary. Each may
+// also be read from a file named by the variable with a _FILE suffix.
+var secretVars = map[string]bool{
+	"COLLECT_INFLUXDB_TOKEN": true,
+	"COLLECT_INFLUXDB_PROXY": true,
+	"COLLECT_WEBHOOK_URL":    true,
+	"COLLECT_MQTT_URL":       true,
+	"COLLECT_NATS_URL":       true,
+}
+
+// loadSecretFiles sets each secret variable from the file named by its _FILE
+// variant, e.g. COLLECT_INFLUXDB_TOKEN_FILE, as with Docker secrets. Files
+// take precedence over the variables themselves. A single trailing newline is
+// removed.
+func loadSecretFiles() error {
+	for name := range secretVars {
+		filename, ok := os.LookupEnv(name + "_FILE")
+		if !ok {
+			continue
+		}
+
+		val, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return xerrors.Errorf("%s_FILE: %w", name, err)
+		}
+
+		val = bytes.TrimSuffix(val, []byte("\n"))
+		val = bytes.TrimSuffix(val, []byte("\r"))
+		if err := os.Setenv(name, string(val)); err != nil {
+			return xerrors.Errorf("os.Setenv: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateEnv checks for missing and incomplete configuration, returning a
+// description of each problem found.
+func validateEnv(dryRun, influx bool) (problems []string) {
+	required := requiredVars
+	if influx {
+		required = append(influxVars, required...)
+	}
+
+	if !dryRun {
+		for _, name := range required {
+			if _, ok := os.LookupEnv(name); !ok {
+				problems = append(problems, fmt.Sprintf("%s undefined", name))
+			}
+		}
+	}
+
+	for _, pair := range pairedVars {
+		_, ok0 := os.LookupEnv(pair[0])
+		_, ok1 := os.LookupEnv(pair[1])
+		if ok0 != ok1 {
+			problems = append(problems, fmt.Sprintf("%s and %s must be defined together", pair[0], pair[1]))
+		}
+	}
+
+	for _, dep := range dependentVars {
+		_, ok0 := os.LookupEnv(dep[0])
+		_, ok1 := os.LookupEnv(dep[1])
+		if ok0 && !ok1 {
+			problems = append(problems, fmt.Sprintf("%s requires %s", dep[0], dep[1]))
+		}
+	}
+
+	return problems
+}
+
+// logEnvSummary logs the effective configuration with secrets masked.
+func logEnvSummary() {
+	var vars []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "COLLECT_") {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars)
+
+	for idx, kv := range vars {
+		name := kv[:strings.Index(kv, "=")]
+		if secretVars[name] {
+			vars[idx] = name + "=********"
+		}
+	}
+
+	log.Infof("configuration: %s", strings.Join(vars, " "))
+}
+
+// Units are the units of consumption for meters, by endpoint id or endpoint
+// type. Endpoint ids take precedence.
+type Units struct {
+	ByID   map[uint32]string
+	ByType map[uint8]string
+}
+
+// Unit returns the meter's unit, if known.
+func (u Units) Unit(meter Meter) (unit string, ok bool) {
+	if unit, ok = u.ByID[meter.EndpointID]; ok {
+		return unit, true
+	}
+	unit, ok = u.ByType[meter.EndpointType]
+	return unit, ok
+}
+
+// checkLineProtocol reports names and tag values which can't be written as
+// InfluxDB line protocol. Spaces, commas and equals signs are escaped when
+// points are encoded, but backslashes are not: a trailing backslash, or one
+// before a space, comma or equals sign, would escape the separator which
+// follows it. Control characters such as line breaks and tabs aren't escaped
+// either, and would split or corrupt the point. A lone space, comma or equals
+// sign can't be a field key in the write-ahead log.
+func checkLineProtocol(strs ...string) error {
+	for _, s := range strs {
+		if s == " " || s == "," || s == "=" {
+			return xerrors.Errorf("%q can't be a name on its own", s)
+		}
+		if strings.HasSuffix(s, `\`) {
+			return xerrors.Errorf("%q ends with a backslash", s)
+		}
+		for _, seq := range []string{`\ `, `\,`, `\=`} {
+			if strings.Contains(s, seq) {
+				return xerrors.Errorf("%q contains a backslash before %q", s, seq[1:])
+			}
+		}
+		for _, r := range s {
+			if unicode.IsControl(r) {
+				return xerrors.Errorf("%q contains the control character %q", s, r)
+			}
+		}
+	}
+	return nil
+}
+
+// parseUnits parses a comma-separated list of id:<endpoint id>=<unit> and
+// type:<endpoint type>=<unit> pairs.
+func parseUnits(s string) (units Units, err error) {
+	units = Units{ByID: map[uint32]string{}, ByType: map[uint8]string{}}
+
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return units, err
+	}
+
+	for key, unit := range kv {
+		switch {
+		case strings.HasPrefix(key, "id:"):
+			id, err := strconv.ParseUint(strings.TrimPrefix(key, "id:"), 10, 32)
+			if err != nil {
+				return units, xerrors.Errorf("strconv.ParseUint: %w", err)
+			}
+			units.ByID[uint32(id)] = unit
+		case strings.HasPrefix(key, "type:"):
+			endpointType, err := strconv.ParseUint(strings.TrimPrefix(key, "type:"), 10, 8)
+			if err != nil {
+				return units, xerrors.Errorf("strconv.ParseUint: %w", err)
+			}
+			units.ByType[uint8(endpointType)] = unit
+		default:
+			return units, xerrors.Errorf("invalid key %q, expected id:<endpoint id> or type:<endpoint type>", key)
+		}
+	}
+
+	return units, nil
+}
+
+// IDRange assigns Group to endpoint ids from Min to Max inclusive.
+type IDRange struct {
+	Min, Max uint32
+	Group    string
+}
+
+// parseIDRanges parses a comma-separated list of <min>-<max>=<group> and
+// <id>=<group> pairs, keeping their order.
+func parseIDRanges(s string) (ranges []IDRange, err error) {
+	for _, pair := range strings.Split(s, ",") {
+		ids := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(ids) != 2 || ids[1] == "" {
+			return nil, xerrors.Errorf("invalid range %q, expected <min>-<max>=<group>", pair)
+		}
+
+		bounds := strings.SplitN(ids[0], "-", 2)
+		min, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, xerrors.Errorf("strconv.ParseUint: %w", err)
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil {
+				return nil, xerrors.Errorf("strconv.ParseUint: %w", err)
+			}
+		}
+		if max < min {
+			return nil, xerrors.Errorf("invalid range %q, min exceeds max", pair)
+		}
+
+		ranges = append(ranges, IDRange{uint32(min), uint32(max), ids[1]})
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,278 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+)
+
+// roundTrip encodes a point using name as its measurement, a tag key, a tag
+// value and a field key, both as written to InfluxDB and to the write-ahead
+// log, and reports whether parsing each gives back the same point.
+func roundTrip(t *testing.T, name string) bool {
+	t.Helper()
+
+	pt := write.NewPoint(name, map[string]string{name: "v", "k": name}, map[string]interface{}{name: int64(1)}, testTime)
+
+	var wal bytes.Buffer
+	enc := lp.NewEncoder(&wal)
+	enc.SetFieldTypeSupport(lp.UintSupport)
+	enc.FailOnFieldErr(true)
+	if _, err := enc.Encode(pt); err != nil {
+		return false
+	}
+
+	for _, line := range []string{write.PointToLineProtocol(pt, time.Nanosecond), wal.String()} {
+		metrics, err := lp.NewParser(lp.NewMetricHandler()).Parse([]byte(line))
+		if err != nil || len(metrics) != 1 {
+			return false
+		}
+
+		m := metrics[0]
+		tags := map[string]string{}
+		for _, tag := range m.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		fields := m.FieldList()
+		if m.Name() != name || len(tags) != 2 || tags[name] != "v" || tags["k"] != name ||
+			len(fields) != 1 || fields[0].Key != name || !m.Time().Equal(testTime) {
+			t.Logf("%q: encoded as %q, parsed as %s %v %v", name, line, m.Name(), tags, fields)
+			return false
+		}
+	}
+	return true
+}
+
+// TestCheckLineProtocol checks that names accepted by checkLineProtocol
+// survive a round trip through line protocol, and that those it rejects
+// don't.
+func TestCheckLineProtocol(t *testing.T) {
+	cases := []struct {
+		Name string
+		Ok   bool
+	}{
+		{"rtlamr", true},
+		{"basement meter", true},
+		{" leading and trailing ", true},
+		{"a,b", true},
+		{",a", true},
+		{"a=b", true},
+		{"x=", true},
+		{`"quoted"`, true},
+		{`a"b`, true},
+		{`a\b`, true},
+		{`a\\b`, true},
+		{`a\"b`, true},
+		{"é", true},
+		{`trailing\`, false},
+		{`a\ b`, false},
+		{`a\,b`, false},
+		{`a\=b`, false},
+		{" ", false},
+		{",", false},
+		{"=", false},
+		{"line\nbreak", false},
+		{"carriage\rreturn", false},
+		{"tab\tulated", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			err := checkLineProtocol(c.Name)
+			if ok := err == nil; ok != c.Ok {
+				t.Fatalf("checkLineProtocol(%q) = %v, want ok %v", c.Name, err, c.Ok)
+			}
+			if ok := roundTrip(t, c.Name); ok != c.Ok {
+				t.Errorf("round trip of %q ok %v, want %v", c.Name, ok, c.Ok)
+			}
+		})
+	}
+}
+
+// TestLoadConfigFile checks that flags in a config file are parsed as
+// booleans, that other values are exported as written, and that nested
+// sections are rejected.
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtlamr-collect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []string{
+		"COLLECT_STRICTIDM", "COLLECT_DROP_ZERO", "COLLECT_MONOTONIC",
+		"COLLECT_ENABLE_SCM", "COLLECT_MAX_SERIES", "COLLECT_INFLUXDB_HOSTNAME",
+	}
+	unset := func() {
+		for _, key := range keys {
+			os.Unsetenv(key)
+		}
+	}
+
+	cases := []struct {
+		Name    string
+		Content string
+		Want    map[string]string // keys missing from Want must be undefined
+		Err     string
+	}{
+		{
+			Name: "flags.yaml",
+			Content: "---\n# comment\n" +
+				"COLLECT_STRICTIDM: false\n" +
+				"COLLECT_DROP_ZERO: 0\n" +
+				"COLLECT_MONOTONIC: true # enabled\n" +
+				"COLLECT_ENABLE_SCM: false\n" +
+				"COLLECT_MAX_SERIES: 0\n" +
+				"COLLECT_INFLUXDB_HOSTNAME: https://localhost:8086/\n",
+			Want: map[string]string{
+				"COLLECT_MONOTONIC":         "true",
+				"COLLECT_ENABLE_SCM":        "false",
+				"COLLECT_MAX_SERIES":        "0",
+				"COLLECT_INFLUXDB_HOSTNAME": "https://localhost:8086/",
+			},
+		},
+		{
+			Name: "flags.toml",
+			Content: "COLLECT_STRICTIDM = false\n" +
+				"COLLECT_DROP_ZERO = \"0\"\n" +
+				"COLLECT_MONOTONIC = 1\n" +
+				"COLLECT_INFLUXDB_HOSTNAME = \"https://localhost:8086/\"\n",
+			Want: map[string]string{
+				"COLLECT_MONOTONIC":         "1",
+				"COLLECT_INFLUXDB_HOSTNAME": "https://localhost:8086/",
+			},
+		},
+		{
+			Name:    "notbool.yaml",
+			Content: "COLLECT_STRICTIDM: yes\n",
+			Err:     "expected true or false",
+		},
+		{
+			Name:    "table.toml",
+			Content: "COLLECT_MONOTONIC = true\n[influxdb]\nhostname = \"https://localhost:8086/\"\n",
+			Err:     "nested sections are not supported",
+		},
+		{
+			Name:    "mapping.yaml",
+			Content: "influxdb:\n  hostname: https://localhost:8086/\n",
+			Err:     "nested sections are not supported",
+		},
+		{
+			Name:    "list.yaml",
+			Content: "COLLECT_KNOWN_METERS:\n- 12345678\n",
+			Err:     "nested sections are not supported",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			unset()
+			defer unset()
+
+			filename := filepath.Join(dir, c.Name)
+			if err := ioutil.WriteFile(filename, []byte(c.Content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigFile(filename)
+			if c.Err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Err) {
+					t.Fatalf("loadConfigFile: %v, want error containing %q", err, c.Err)
+				}
+				for _, key := range keys {
+					if val, ok := os.LookupEnv(key); ok {
+						t.Errorf("%s = %q exported from a file with errors", key, val)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigFile: %+v", err)
+			}
+
+			for _, key := range keys {
+				val, ok := os.LookupEnv(key)
+				want, wantOk := c.Want[key]
+				if ok != wantOk || val != want {
+					t.Errorf("%s = %q (defined %v), want %q (defined %v)", key, val, ok, want, wantOk)
+				}
+			}
+		})
+	}
+
+	t.Run("precedence", func(t *testing.T) {
+		unset()
+		defer unset()
+
+		filename := filepath.Join(dir, "precedence.yaml")
+		if err := ioutil.WriteFile(filename, []byte("COLLECT_MAX_SERIES: 10\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Setenv("COLLECT_MAX_SERIES", "5")
+		if err := loadConfigFile(filename); err != nil {
+			t.Fatalf("loadConfigFile: %+v", err)
+		}
+		if val := os.Getenv("COLLECT_MAX_SERIES"); val != "5" {
+			t.Errorf("COLLECT_MAX_SERIES = %q, want the environment's 5", val)
+		}
+	})
+}
+
+// TestConfigFlags checks that every variable read only for whether it is
+// defined is listed in configFlags, so a config file can't enable it with
+// false.
+func TestConfigFlags(t *testing.T) {
+	flagLookup := regexp.MustCompile(`_, [\w.]+ :?= os\.LookupEnv\("(COLLECT_\w+)"\)`)
+
+	filenames, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for _, filename := range filenames {
+		if strings.HasSuffix(filename, "_test.go") {
+			continue
+		}
+
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, match := range flagLookup.FindAllSubmatch(src, -1) {
+			found++
+			if key := string(match[1]); !configFlags[key] {
+				t.Errorf("%s: flag %s is missing from configFlags", filename, key)
+			}
+		}
+	}
+
+	if found == 0 {
+		t.Fatal("no flags found")
+	}
+}
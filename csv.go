@@ -0,0 +1,130 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// csvPrefix is the number of columns rtlamr writes ahead of the message
+// fields: time, offset and length.
+const csvPrefix = 3
+
+// csvProtocol maps the columns of an rtlamr csv record to the json field
+// names of a message. Empty names are ignored.
+type csvProtocol struct {
+	Type    string
+	Columns []string
+}
+
+// csvProtocols lists the column layout of each message rtlamr can produce.
+// rtlamr doesn't include the message type in csv records, so the type is
+// determined by the number of columns.
+var csvProtocols = []csvProtocol{
+	{"SCM", []string{
+		"ID", "Type", "", "", "Consumption", "",
+	}},
+	{"SCM+", []string{
+		"", "", "EndpointType", "EndpointID", "Consumption", "", "",
+	}},
+	{"R900", []string{
+		"ID", "Unkn1", "NoUse", "BackFlow", "Consumption", "Unkn3", "Leak", "LeakNow",
+	}},
+	{"NetIDM", []string{
+		"", "", "", "", "", "ERTType", "ERTSerialNumber", "ConsumptionIntervalCount",
+		"", "LastGeneration", "LastConsumption", "LastConsumptionNet",
+		"DifferentialConsumptionIntervals", "TransmitTimeOffset", "", "",
+	}},
+	{"IDM", []string{
+		"", "", "", "", "", "ERTType", "ERTSerialNumber", "ConsumptionIntervalCount",
+		"", "", "", "PowerOutageFlags", "LastConsumptionCount",
+		"DifferentialConsumptionIntervals", "TransmitTimeOffset", "", "",
+	}},
+}
+
+// parseCSV converts an rtlamr csv record to a LogMessage.
+func parseCSV(line []byte) (msg LogMessage, err error) {
+	record, err := csv.NewReader(strings.NewReader(string(line))).Read()
+	if err != nil {
+		return msg, xerrors.Errorf("csv.Read: %w", err)
+	}
+
+	var protocol *csvProtocol
+	for idx := range csvProtocols {
+		if len(csvProtocols[idx].Columns)+csvPrefix == len(record) {
+			protocol = &csvProtocols[idx]
+			break
+		}
+	}
+	if protocol == nil {
+		return msg, xerrors.Errorf("unknown csv record with %d columns", len(record))
+	}
+
+	msg.Type = protocol.Type
+	msg.Time, _, err = parseTimeString(record[0])
+	if err != nil {
+		return msg, xerrors.Errorf("parseTimeString: %w", err)
+	}
+
+	fields := map[string]interface{}{}
+	for idx, name := range protocol.Columns {
+		if name == "" {
+			continue
+		}
+
+		fields[name], err = parseCSVValue(record[idx+csvPrefix])
+		if err != nil {
+			return msg, xerrors.Errorf("column %s: %w", name, err)
+		}
+	}
+
+	msg.Message, err = json.Marshal(fields)
+	if err != nil {
+		return msg, xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	return msg, nil
+}
+
+// parseCSVValue converts a single csv value to a type suitable for json
+// encoding. Hex values become byte slices, bracketed lists become integer
+// slices and everything else is an integer.
+func parseCSVValue(val string) (interface{}, error) {
+	val = strings.TrimSpace(val)
+
+	switch {
+	case strings.HasPrefix(val, "0x"):
+		return hex.DecodeString(val[2:])
+	case strings.HasPrefix(val, "["):
+		list := []int64{}
+		for _, elem := range strings.Fields(strings.Trim(val, "[]")) {
+			v, err := strconv.ParseInt(elem, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+
+	return strconv.ParseInt(val, 10, 64)
+}
@@ -0,0 +1,236 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// MeterFilter limits which meters are written to protect the database from
+// series cardinality explosions in dense neighborhoods.
+type MeterFilter struct {
+	// Known endpoint ids are always allowed. If not empty, all other meters
+	// are dropped.
+	Known map[uint32]bool
+
+	// Max is the number of distinct meters allowed, zero is unlimited.
+	Max int
+
+	allowed map[Meter]bool
+	dropped map[Meter]bool
+}
+
+// Allow reports whether points for meter may be written. Meters are allowed
+// in the order they are first heard from until Max is reached.
+func (f *MeterFilter) Allow(meter Meter) bool {
+	if len(f.Known) > 0 && !f.Known[meter.EndpointID] {
+		return false
+	}
+
+	if f.Max <= 0 || f.allowed[meter] {
+		return true
+	}
+
+	if len(f.allowed) < f.Max {
+		if f.allowed == nil {
+			f.allowed = map[Meter]bool{}
+		}
+		f.allowed[meter] = true
+		return true
+	}
+
+	if f.dropped == nil {
+		f.dropped = map[Meter]bool{}
+	}
+	if !f.dropped[meter] {
+		f.dropped[meter] = true
+		log.Warnf("COLLECT_MAX_SERIES reached, dropping meter %d (%s)", meter.EndpointID, meter.Protocol)
+	}
+
+	return false
+}
+
+// IDMResolver prevents a meter from being written under both the IDM and
+// NetIDM interpretations. rtlamr decodes every IDM-style packet as both, and
+// the two disagree on where consumption is stored, so writing both yields two
+// conflicting consumption series for the same meter.
+type IDMResolver struct {
+	resolved map[Meter]string
+	// pending holds the interpretation each unresolved meter was first heard
+	// under.
+	pending map[Meter]string
+}
+
+// Allow reports whether meter's message may be written. Type 7 is always IDM
+// and type 8 always NetIDM. Any other type is held back until it is heard a
+// second time, either as the other interpretation of the same packet or as
+// the next packet when rtlamr only decodes one of them, and then belongs to
+// the interpretation it was first heard under.
+func (r *IDMResolver) Allow(meter Meter) bool {
+	if meter.Protocol != "IDM" && meter.Protocol != "NetIDM" {
+		return true
+	}
+
+	switch meter.EndpointType {
+	case 7:
+		return meter.Protocol == "IDM"
+	case 8:
+		return meter.Protocol == "NetIDM"
+	}
+
+	key := Meter{EndpointID: meter.EndpointID, EndpointType: meter.EndpointType}
+	if r.resolved == nil {
+		r.resolved = map[Meter]string{}
+		r.pending = map[Meter]string{}
+	}
+
+	if protocol, ok := r.resolved[key]; ok {
+		return protocol == meter.Protocol
+	}
+
+	protocol, ok := r.pending[key]
+	if !ok {
+		r.pending[key] = meter.Protocol
+		return false
+	}
+
+	delete(r.pending, key)
+	r.resolved[key] = protocol
+	log.Infof("meter %d resolved as %s", meter.EndpointID, protocol)
+
+	return protocol == meter.Protocol
+}
+
+// dupFilterSize is the number of recent messages remembered by DupFilter.
+const dupFilterSize = 1024
+
+// DupFilter drops byte-identical messages from a meter received within a
+// short window of each other, such as a single transmission decoded twice due
+// to multipath.
+type DupFilter struct {
+	Window time.Duration
+
+	// recent holds the most recently received messages first.
+	recent  *list.List
+	entries map[dupKey]*list.Element
+}
+
+type dupKey struct {
+	meter Meter
+	hash  uint64
+}
+
+type dupEntry struct {
+	key  dupKey
+	time time.Time
+}
+
+// Duplicate reports whether an identical payload was received from meter
+// within Window of t. Only the least recently received messages are forgotten
+// once dupFilterSize is exceeded.
+func (f *DupFilter) Duplicate(meter Meter, payload []byte, t time.Time) bool {
+	if f.Window <= 0 {
+		return false
+	}
+	if f.entries == nil {
+		f.recent = list.New()
+		f.entries = map[dupKey]*list.Element{}
+	}
+
+	h := fnv.New64a()
+	h.Write(payload)
+	key := dupKey{meter, h.Sum64()}
+
+	if elem, ok := f.entries[key]; ok {
+		f.recent.MoveToFront(elem)
+
+		entry := elem.Value.(*dupEntry)
+		diff := t.Sub(entry.time)
+		if diff > -f.Window && diff < f.Window {
+			return true
+		}
+		entry.time = t
+		return false
+	}
+
+	f.entries[key] = f.recent.PushFront(&dupEntry{key, t})
+	if f.recent.Len() > dupFilterSize {
+		oldest := f.recent.Remove(f.recent.Back()).(*dupEntry)
+		delete(f.entries, oldest.key)
+	}
+
+	return false
+}
+
+// BucketFilter drops cumulative messages whose consumption was already
+// written for the meter within the same time bucket, where time is rounded
+// down to a multiple of Bucket. Only SCM, SCM+ and R900 messages are checked:
+// IDM and NetIDM messages also carry differential intervals, which would be
+// dropped with them, and are deduplicated by interval instead.
+type BucketFilter struct {
+	Bucket time.Duration
+
+	last map[Meter]bucketEntry
+}
+
+type bucketEntry struct {
+	bucket      time.Time
+	consumption uint32
+}
+
+// Duplicate reports whether consumption was already seen from meter in the
+// bucket containing t. Only each meter's most recent bucket is remembered.
+func (f *BucketFilter) Duplicate(meter Meter, consumption uint32, t time.Time) bool {
+	if f.Bucket <= 0 {
+		return false
+	}
+	if f.last == nil {
+		f.last = map[Meter]bucketEntry{}
+	}
+
+	entry := bucketEntry{t.Truncate(f.Bucket), consumption}
+	if f.last[meter] == entry {
+		return true
+	}
+	f.last[meter] = entry
+
+	return false
+}
+
+// parseEndpointIDs parses a comma-separated list of endpoint ids.
+func parseEndpointIDs(s string) (map[uint32]bool, error) {
+	ids := map[uint32]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, xerrors.Errorf("strconv.ParseUint: %w", err)
+		}
+		ids[uint32(id)] = true
+	}
+	return ids, nil
+}
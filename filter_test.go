@@ -0,0 +1,51 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestIDMResolver(t *testing.T) {
+	cases := []struct {
+		Name string
+		// Heard is the sequence of protocols a meter is heard under.
+		Heard []string
+		Type  uint8
+		Want  []bool
+	}{
+		{"type 7", []string{"NetIDM", "IDM", "NetIDM", "IDM"}, 7, []bool{false, true, false, true}},
+		{"type 8", []string{"IDM", "NetIDM", "IDM", "NetIDM"}, 8, []bool{false, true, false, true}},
+		{"other type, IDM first", []string{"IDM", "NetIDM", "IDM", "NetIDM"}, 3, []bool{false, false, true, false}},
+		{"other type, NetIDM first", []string{"NetIDM", "IDM", "NetIDM", "IDM"}, 3, []bool{false, false, true, false}},
+		{"other type, IDM only", []string{"IDM", "IDM", "IDM"}, 3, []bool{false, true, true}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := IDMResolver{}
+			for i, protocol := range c.Heard {
+				meter := Meter{EndpointID: 1, EndpointType: c.Type, Protocol: protocol}
+				if got := r.Allow(meter); got != c.Want[i] {
+					t.Errorf("message %d (%s): got %v, want %v", i, protocol, got, c.Want[i])
+				}
+			}
+		})
+	}
+
+	r := IDMResolver{}
+	if !r.Allow(Meter{EndpointID: 1, EndpointType: 3, Protocol: "SCM"}) {
+		t.Error("SCM message was held back")
+	}
+}
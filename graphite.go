@@ -0,0 +1,163 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// graphiteTimeout bounds connecting to and writing to the server.
+const graphiteTimeout = 10 * time.Second
+
+// defaultGraphitePrefix is the metric path written before each field's name
+// unless COLLECT_GRAPHITE_PREFIX is defined.
+const defaultGraphitePrefix = "rtlamr.{protocol}.{endpoint_id}.{msg_type}"
+
+// graphitePlaceholder matches a tag name in braces in a metric prefix.
+var graphitePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// graphiteUnsafe matches characters which separate or are otherwise special
+// in a metric path node.
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// GraphiteSink writes each numeric field of each point as a line of Carbon's
+// plaintext protocol, <prefix>.<field> <value> <timestamp>, over TCP. The
+// prefix's placeholders are replaced by the point's measurement and tags. The
+// connection is re-established when a write fails.
+type GraphiteSink struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+
+	buf bytes.Buffer
+}
+
+func NewGraphiteSink(addr, prefix string) (*GraphiteSink, error) {
+	s := &GraphiteSink{addr: addr, prefix: prefix}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *GraphiteSink) dial() error {
+	conn, err := net.DialTimeout("tcp", s.addr, graphiteTimeout)
+	if err != nil {
+		return xerrors.Errorf("net.DialTimeout: %w", err)
+	}
+	s.conn = conn
+	return nil
+}
+
+// metricPrefix replaces each placeholder in the prefix with the value of the
+// tag it names, or the point's measurement for {measurement}. Dots and other
+// special characters in tag values are replaced by underscores, so each is a
+// single node, and missing tags are left empty.
+func (s *GraphiteSink) metricPrefix(tags map[string]string) string {
+	return graphitePlaceholder.ReplaceAllStringFunc(s.prefix, func(placeholder string) string {
+		return graphiteUnsafe.ReplaceAllString(tags[strings.Trim(placeholder, "{}")], "_")
+	})
+}
+
+// graphiteValue formats a field value, reporting false for those Graphite
+// can't store, such as strings.
+func graphiteValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+// WritePoints writes the lines for every point in a single write. If the
+// write fails, the batch is retried once on a new connection.
+func (s *GraphiteSink) WritePoints(pts []*write.Point) error {
+	s.buf.Reset()
+	for _, pt := range pts {
+		tags := map[string]string{"measurement": pt.Name()}
+		for _, tag := range pt.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		prefix := s.metricPrefix(tags)
+
+		for _, field := range pt.FieldList() {
+			value, ok := graphiteValue(field.Value)
+			if !ok {
+				continue
+			}
+
+			name := graphiteUnsafe.ReplaceAllString(field.Key, "_")
+			fmt.Fprintf(&s.buf, "%s.%s %s %d\n", prefix, name, value, pt.Time().Unix())
+		}
+	}
+
+	if s.buf.Len() == 0 {
+		return nil
+	}
+
+	err := s.send()
+	if err == nil {
+		return nil
+	}
+	log.Warnf("graphite: %+v, reconnecting", err)
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.dial(); err != nil {
+		return err
+	}
+	return s.send()
+}
+
+func (s *GraphiteSink) send() error {
+	if s.conn == nil {
+		return xerrors.New("not connected")
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		return xerrors.Errorf("conn.Write: %w", err)
+	}
+	return nil
+}
+
+func (s *GraphiteSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,232 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// newInfluxDBClient creates a client for the server described by cfg.
+func newInfluxDBClient(cfg Config) (influxdb2.Client, error) {
+	opts := influxdb2.DefaultOptions()
+
+	tlsConfig := &tls.Config{}
+
+	if cfg.ClientCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, xerrors.Errorf("could not load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, xerrors.Errorf("could not load ca certificate: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, xerrors.Errorf("could not load ca certificate: no certificates found in %q", cfg.CACert)
+		}
+	}
+
+	if cfg.InsecureSkipVerify {
+		log.Warn("COLLECT_INFLUXDB_INSECURE_SKIP_VERIFY is set, the server's certificate will not be verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	// The client's default transport ignores proxies, so it is replaced with
+	// one which otherwise matches it. Requests may take as long as a write.
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+
+	opts.SetHTTPClient(&http.Client{
+		Timeout:   cfg.WriteTimeout,
+		Transport: userAgentTransport{cfg.UserAgent, transport},
+	})
+
+	log.Printf("connecting to %q", cfg.Hostname)
+	return influxdb2.NewClientWithOptions(cfg.Hostname, cfg.Token, opts), nil
+}
+
+// userAgentTransport replaces the User-Agent header of each request, which the
+// client otherwise always sets to its own.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the request it was given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// preflightTimeout bounds the connectivity check made on startup.
+const preflightTimeout = 10 * time.Second
+
+// authError describes err if it is the server rejecting the token, returning
+// nil otherwise.
+func authError(err error, bucket string) error {
+	var httpErr *http2.Error
+	if !xerrors.As(err, &httpErr) {
+		return nil
+	}
+
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized:
+		return xerrors.Errorf("token rejected, check COLLECT_INFLUXDB_TOKEN: %w", err)
+	case http.StatusForbidden:
+		return xerrors.Errorf("token lacks write permission for bucket %q: %w", bucket, err)
+	}
+	return nil
+}
+
+// preflight verifies the server is reachable and healthy, and that it accepts
+// the token for writes to bucket.
+func preflight(client influxdb2.Client, writeAPI api.WriteAPIBlocking, bucket string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	health, err := client.Health(ctx)
+	if err != nil {
+		return xerrors.Errorf("server unreachable: %w", err)
+	}
+
+	if health.Status != domain.HealthCheckStatusPass {
+		msg := "no message"
+		if health.Message != nil {
+			msg = *health.Message
+		}
+		return xerrors.Errorf("server unhealthy: %s", msg)
+	}
+
+	// An empty write checks the token without writing any data. Servers may
+	// reject the empty body itself, so only authorization failures count.
+	err = writeAPI.WritePoint(ctx)
+	if err := authError(err, bucket); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// testMeasurement is written to by the test subcommand.
+const testMeasurement = "rtlamr_collect_test"
+
+// testInfluxDB connects to the server described by cfg and writes a single
+// point to the bucket.
+func testInfluxDB(cfg Config) error {
+	if cfg.DryRun || cfg.Output != "influxdb" {
+		return xerrors.New("only COLLECT_OUTPUT=influxdb can be tested")
+	}
+
+	client, err := newInfluxDBClient(cfg)
+	if err != nil {
+		return xerrors.Errorf("newInfluxDBClient: %w", err)
+	}
+	defer client.Close()
+
+	writeAPI := client.WriteAPIBlocking(cfg.Org, cfg.Bucket)
+	if err := preflight(client, writeAPI, cfg.Bucket); err != nil {
+		return xerrors.Errorf("preflight: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WriteTimeout)
+	defer cancel()
+
+	pt := influxdb2.NewPoint(testMeasurement, nil, map[string]interface{}{"test": int64(1)}, time.Now())
+	if err := writeAPI.WritePoint(ctx, pt); err != nil {
+		if err := authError(err, cfg.Bucket); err != nil {
+			return err
+		}
+		return xerrors.Errorf("could not write to bucket %q: %w", cfg.Bucket, err)
+	}
+
+	return nil
+}
+
+// ensureBucket creates the bucket if it doesn't exist. A zero retention keeps
+// data forever.
+func ensureBucket(client influxdb2.Client, org, bucket string, retention time.Duration) (created bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	// FindBucketByName reports a missing bucket with an untyped error, any
+	// error from the server itself is a real failure.
+	_, err = client.BucketsAPI().FindBucketByName(ctx, bucket)
+	if err == nil {
+		return false, nil
+	}
+
+	var httpErr *http2.Error
+	if xerrors.As(err, &httpErr) {
+		return false, xerrors.Errorf("FindBucketByName: %w", err)
+	}
+
+	orgInfo, err := client.OrganizationsAPI().FindOrganizationByName(ctx, org)
+	if err != nil {
+		return false, xerrors.Errorf("FindOrganizationByName: %w", err)
+	}
+
+	var rules []domain.RetentionRule
+	if retention > 0 {
+		rules = append(rules, domain.RetentionRule{
+			EverySeconds: int(retention / time.Second),
+			Type:         domain.RetentionRuleTypeExpire,
+		})
+	}
+
+	_, err = client.BucketsAPI().CreateBucketWithName(ctx, orgInfo, bucket, rules...)
+	if err != nil {
+		return false, xerrors.Errorf("CreateBucketWithName: %w", err)
+	}
+
+	return true, nil
+}
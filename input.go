@@ -0,0 +1,175 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// SocketInput reads newline-delimited messages from every connection to a
+// listening socket, interleaving whole lines from concurrent connections.
+// Lines longer than maxLineBytes are skipped.
+type SocketInput struct {
+	ln           net.Listener
+	maxLineBytes int
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+	mu sync.Mutex
+}
+
+// ListenUnix listens on the socket at path, removing a stale socket left by a
+// previous run.
+func ListenUnix(path string, maxLineBytes int) (*SocketInput, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, xerrors.Errorf("os.Remove: %w", err)
+		}
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, xerrors.Errorf("net.ListenUnix: %w", err)
+	}
+
+	return newSocketInput(ln, maxLineBytes), nil
+}
+
+// ListenTCP listens for connections on the tcp address addr.
+func ListenTCP(addr string, maxLineBytes int) (*SocketInput, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("net.Listen: %w", err)
+	}
+
+	return newSocketInput(ln, maxLineBytes), nil
+}
+
+func newSocketInput(ln net.Listener, maxLineBytes int) *SocketInput {
+	in := &SocketInput{ln: ln, maxLineBytes: maxLineBytes}
+	in.pr, in.pw = io.Pipe()
+
+	go in.accept()
+
+	return in
+}
+
+func (in *SocketInput) accept() {
+	for {
+		conn, err := in.ln.Accept()
+		if err != nil {
+			// The listener was closed, signal EOF to the reader.
+			in.pw.Close()
+			return
+		}
+
+		go in.handle(conn)
+	}
+}
+
+func (in *SocketInput) handle(conn net.Conn) {
+	defer conn.Close()
+	log.Debugf("accepted connection on %s", in.ln.Addr())
+
+	scanner := newLineScanner(conn, in.maxLineBytes)
+	for scanner.Scan() {
+		in.mu.Lock()
+		_, err := in.pw.Write(append(scanner.Bytes(), '\n'))
+		in.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Warnf("connection on %s: %+v", in.ln.Addr(), xerrors.Errorf("scanner.Scan: %w", err))
+	}
+}
+
+func (in *SocketInput) Read(p []byte) (int, error) {
+	return in.pr.Read(p)
+}
+
+// Close stops listening, removing the socket file of a Unix domain socket.
+func (in *SocketInput) Close() error {
+	return in.ln.Close()
+}
+
+// Input is a named source of rtlamr's output.
+type Input struct {
+	// Source is added as the source tag of every point read from the input,
+	// unless empty.
+	Source string
+	io.ReadCloser
+}
+
+// OpenInput opens the input described by spec, one of unix:<path> or
+// tcp:<addr> to listen on a socket, or a file path. Files ending in .gz are
+// decompressed. Sockets skip lines longer than maxLineBytes.
+func OpenInput(source, spec string, maxLineBytes int) (Input, error) {
+	in := Input{Source: source}
+
+	var err error
+	switch {
+	case strings.HasPrefix(spec, "unix:"):
+		in.ReadCloser, err = ListenUnix(strings.TrimPrefix(spec, "unix:"), maxLineBytes)
+	case strings.HasPrefix(spec, "tcp:"):
+		in.ReadCloser, err = ListenTCP(strings.TrimPrefix(spec, "tcp:"), maxLineBytes)
+	case strings.HasSuffix(spec, ".gz"):
+		in.ReadCloser, err = openGzip(spec)
+	default:
+		in.ReadCloser, err = os.Open(spec)
+	}
+	if err != nil {
+		return in, xerrors.Errorf("%s: %w", source, err)
+	}
+
+	return in, nil
+}
+
+// gzipFile decompresses a file, closing both on Close.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func openGzip(filename string) (*gzipFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("os.Open: %w", err)
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("gzip.NewReader: %w", err)
+	}
+
+	return &gzipFile{gz, f}, nil
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.f.Close()
+}
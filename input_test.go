@@ -0,0 +1,77 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSocketInputLongLines checks that a connection accepts lines longer than
+// bufio.Scanner's default limit, and skips lines longer than maxLineBytes
+// without ending the connection.
+func TestSocketInputLongLines(t *testing.T) {
+	const maxLineBytes = 256 << 10
+
+	in, err := ListenTCP("127.0.0.1:0", maxLineBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	lines := make(chan Line, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- readLines(in, "", maxLineBytes, lines, nil)
+		close(lines)
+	}()
+
+	conn, err := net.Dial("tcp", in.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	long := bytes.Repeat([]byte("a"), 100<<10)
+	tooLong := bytes.Repeat([]byte("b"), 2*maxLineBytes)
+
+	var buf bytes.Buffer
+	for _, line := range [][]byte{long, tooLong, []byte("after")} {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range [][]byte{long, []byte("after")} {
+		select {
+		case line := <-lines:
+			if !bytes.Equal(line.Data, want) {
+				t.Fatalf("got line of %d bytes, want %d", len(line.Data), len(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line of %d bytes", len(want))
+		}
+	}
+
+	in.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("readLines: %+v", err)
+	}
+}
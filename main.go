@@ -17,19 +17,26 @@ package main
 
 import (
 	"bufio"
-	"context"
-	"crypto/tls"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
@@ -41,16 +48,175 @@ import (
 
 const threshold = 30 * time.Second
 
+// Build information, set at build time with -ldflags, for example:
+//
+//	-ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// buildVersion returns the version. When built without ldflags, the module
+// version is used if available.
+func buildVersion() string {
+	if version == "dev" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return version
+}
+
+// versionString describes the build.
+func versionString() string {
+	return fmt.Sprintf("rtlamr-collect %s (commit %s, built %s, %s)", buildVersion(), commit, date, runtime.Version())
+}
+
+// probeLines is the number of lines which must fail to parse before any line
+// has parsed successfully to conclude the input isn't from rtlamr.
+const probeLines = 10
+
 // LogMessage is an encapsulating type rtlamr uses for all messages. It contains
 // time, message type, and the encapsulated message.
 type LogMessage struct {
 	Time time.Time
 	Type string
 
+	// Channel is the channel the message was received on, if reported.
+	Channel json.RawMessage
+
 	// Defer decoding until the message type is known.
 	Message json.RawMessage
 }
 
+// timeLayouts are tried in order when parsing message timestamps.
+var timeLayouts = []struct {
+	Name   string
+	Layout string
+}{
+	{"RFC3339Nano", time.RFC3339Nano},
+	{"RFC3339", time.RFC3339},
+	{"RFC3339 (space separated)", "2006-01-02 15:04:05.999999999Z07:00"},
+}
+
+// naiveLayouts are timestamps without a zone offset, interpreted in
+// timeLocation.
+var naiveLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// timeLocation is used to interpret timestamps lacking a zone offset. It is
+// populated from COLLECT_TIMEZONE, if nil such timestamps are rejected.
+var timeLocation *time.Location
+
+// jsonKeys maps each LogMessage field to the key it is read from in JSON
+// input, for rtlamr builds which don't use the default key names. It is
+// populated from COLLECT_JSON_KEYS.
+var jsonKeys map[string]string
+
+// renameKeys rewrites the keys of a JSON object named in jsonKeys to their
+// default LogMessage field names.
+func renameKeys(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	// Renamed keys are read from the original object, since one key may be
+	// renamed to another's default name.
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for key, val := range fields {
+		renamed[key] = val
+	}
+	for _, key := range jsonKeys {
+		delete(renamed, key)
+	}
+	for name, key := range jsonKeys {
+		if val, ok := fields[key]; ok {
+			renamed[name] = val
+		}
+	}
+
+	return json.Marshal(renamed)
+}
+
+// timeLayoutOnce logs the first layout that successfully parses a timestamp.
+var timeLayoutOnce sync.Once
+
+// parseTime parses a message timestamp, either a string in one of the known
+// layouts or a number of seconds since the Unix epoch.
+func parseTime(data json.RawMessage) (t time.Time, layout string, err error) {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var secs float64
+		if err := json.Unmarshal(data, &secs); err != nil {
+			return t, "", xerrors.Errorf("invalid timestamp %s", data)
+		}
+
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)), "Unix seconds", nil
+	}
+
+	return parseTimeString(str)
+}
+
+// parseTimeString parses a timestamp in one of the known layouts.
+func parseTimeString(str string) (t time.Time, layout string, err error) {
+	for _, l := range timeLayouts {
+		if t, err = time.Parse(l.Layout, str); err == nil {
+			return t, l.Name, nil
+		}
+	}
+
+	if timeLocation != nil {
+		for _, l := range naiveLayouts {
+			if t, err = time.ParseInLocation(l, str, timeLocation); err == nil {
+				return t, l + " in " + timeLocation.String(), nil
+			}
+		}
+	}
+
+	return t, "", xerrors.Errorf("unknown timestamp layout %q", str)
+}
+
+// UnmarshalJSON parses a LogMessage, trying each of the known timestamp
+// layouts.
+func (msg *LogMessage) UnmarshalJSON(data []byte) error {
+	type logMessage LogMessage
+	var raw struct {
+		logMessage
+		Time json.RawMessage
+	}
+
+	var err error
+	if len(jsonKeys) > 0 {
+		if data, err = renameKeys(data); err != nil {
+			return err
+		}
+	}
+
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*msg = LogMessage(raw.logMessage)
+
+	var layout string
+	msg.Time, layout, err = parseTime(raw.Time)
+	if err != nil {
+		return xerrors.Errorf("parseTime: %w", err)
+	}
+
+	timeLayoutOnce.Do(func() {
+		log.Infof("parsing timestamps as %s", layout)
+	})
+
+	return nil
+}
+
 func (msg LogMessage) String() string {
 	return fmt.Sprintf("{Time:%s Type:%s}", msg.Time, msg.Type)
 }
@@ -59,6 +225,20 @@ func (msg LogMessage) String() string {
 type IDM struct {
 	Meters MeterMap `json:"-"`
 
+	// DisableDedup writes intervals which have already been written.
+	DisableDedup bool `json:"-"`
+	// IntervalDuration is the time covered by each differential interval.
+	IntervalDuration time.Duration `json:"-"`
+	// Rate writes each interval's consumption per hour as interval_rate.
+	Rate bool `json:"-"`
+	// Extended writes the diagnostic fields below which are present.
+	Extended bool `json:"-"`
+	// TrackFirmware tags points with the application version, if present.
+	TrackFirmware bool `json:"-"`
+	// ChangedOnly writes only differential intervals whose consumption
+	// differs from that last written for the same interval.
+	ChangedOnly bool `json:"-"`
+
 	EndpointType byte     `json:"ERTType"`
 	EndpointID   uint32   `json:"ERTSerialNumber"`
 	TransmitTime uint16   `json:"TransmitTimeOffset"`
@@ -70,6 +250,49 @@ type IDM struct {
 	NetIDMConsumption    uint32 `json:"LastConsumption"`
 	NetIDMConsumptionNet uint32 `json:"LastConsumptionNet"`
 	NetIDMGeneration     uint32 `json:"LastGeneration"`
+
+	// Diagnostic fields, nil if absent. IDM and NetIDM name the programming
+	// state differently.
+	AppVersion          *uint8  `json:"ApplicationVersion"`
+	ProgrammingState    *uint8  `json:"ModuleProgrammingState"`
+	NetProgrammingState *uint8  `json:"ProgrammingState"`
+	TamperCounters      []byte  `json:"TamperCounters"`
+	AsyncCounters       *uint16 `json:"AsynchronousCounters"`
+}
+
+// addExtendedFields adds the diagnostic fields present in the message.
+func (idm IDM) addExtendedFields(fields map[string]interface{}) {
+	if idm.AppVersion != nil {
+		fields["application_version"] = int64(*idm.AppVersion)
+	}
+	if idm.ProgrammingState != nil {
+		fields["programming_state"] = int64(*idm.ProgrammingState)
+	}
+	if idm.NetProgrammingState != nil {
+		fields["programming_state"] = int64(*idm.NetProgrammingState)
+	}
+	if len(idm.TamperCounters) > 0 && len(idm.TamperCounters) <= 8 {
+		// Tamper counters (6 bytes) are written as a single integer.
+		tamperBytes := make([]byte, 8)
+		copy(tamperBytes[8-len(idm.TamperCounters):], idm.TamperCounters)
+		fields["tamper_counters"] = int64(binary.BigEndian.Uint64(tamperBytes))
+	}
+	if idm.AsyncCounters != nil {
+		fields["async_counters"] = int64(*idm.AsyncCounters)
+	}
+}
+
+// addFirmwareTag adds the fw_version tag if enabled and the message reports
+// an application version.
+func (idm IDM) addFirmwareTag(tags map[string]string) {
+	if idm.TrackFirmware && idm.AppVersion != nil {
+		tags["fw_version"] = strconv.FormatUint(uint64(*idm.AppVersion), 10)
+	}
+}
+
+// Meter identifies the meter which transmitted the message.
+func (idm IDM) Meter(protocol string) Meter {
+	return Meter{idm.EndpointID, idm.EndpointType, protocol}
 }
 
 // AddPoints adds differential usage data to a batch of points.
@@ -77,31 +300,28 @@ func (idm IDM) AddPoints(msg LogMessage, eachFn EachFn) {
 	// TransmitTime is 1/16ths of a second since the interval began.
 	intervalOffset := time.Duration(idm.TransmitTime) * time.Second / 16
 
-	meter := Meter{idm.EndpointID, idm.EndpointType, msg.Type}
+	meter := idm.Meter(msg.Type)
 
 	// Does this meter have any state?
-	state, seen := idm.Meters.m[meter]
+	state, seen := idm.Meters.Last(meter)
+
+	outage := idm.outageFlags()
+
+	// The outage bit of the most recent interval is the meter's current state.
+	inOutage := outageBit(outage, 0)
 
 	// Update the meter map with new state.
 	idm.Meters.Update(
 		meter,
 		LastMessage{
-			msg.Time.Add(-intervalOffset),
-			uint(idm.IntervalIdx),
+			Time:     msg.Time.Add(-intervalOffset),
+			Interval: uint(idm.IntervalIdx),
+			Outage:   inOutage,
 		},
 	)
 
-	// Convert outage flags (6 bytes) to uint64 (8 bytes)
-	outageBytes := make([]uint8, 8)
-	copy(outageBytes[2:], idm.Outage)
-	outage := binary.BigEndian.Uint64(outageBytes)
-
-	tags := map[string]string{
-		"protocol":      msg.Type,
-		"msg_type":      "cumulative",
-		"endpoint_type": strconv.Itoa(int(idm.EndpointType)),
-		"endpoint_id":   strconv.Itoa(int(idm.EndpointID)),
-	}
+	tags := newTags(msg, "cumulative", idm.EndpointType, idm.EndpointID)
+	idm.addFirmwareTag(tags)
 
 	fields := map[string]interface{}{
 		"consumption": int64(idm.IDMConsumption),
@@ -113,21 +333,43 @@ func (idm IDM) AddPoints(msg LogMessage, eachFn EachFn) {
 		fields["consumption_net"] = int64(idm.NetIDMConsumptionNet)
 	}
 
+	if idm.Extended {
+		idm.addExtendedFields(fields)
+	}
+
 	eachFn(msg.Time.Add(-intervalOffset), tags, fields)
 
+	// Emit an event when the meter enters or recovers from an outage.
+	if seen && inOutage != state.Outage {
+		event := int64(0)
+		if inOutage {
+			event = 1
+		}
+
+		eventTags := newTags(msg, "event", idm.EndpointType, idm.EndpointID)
+		idm.addFirmwareTag(eventTags)
+
+		eachFn(
+			msg.Time.Add(-intervalOffset),
+			eventTags,
+			map[string]interface{}{"outage_event": event},
+		)
+	}
+
 	// Re-use tags from cumulative message.
-	tags["msg_type"] = "differential"
+	tags["msg_type"] = msgTypeName("differential")
 
 	// For each differential interval.
 	for idx, usage := range idm.IntervalDiff {
-		// Calculate the interval.
-		interval := uint(int(idm.IntervalIdx)-idx) % 256
+		// Calculate the interval. The interval count is a byte, so intervals
+		// before 0 wrap around to 255.
+		interval := uint(byte(int(idm.IntervalIdx) - idx))
 
 		// Calculate the interval's timestamp.
-		intervalTime := msg.Time.Add(-time.Duration(idx)*5*time.Minute - intervalOffset)
+		intervalTime := msg.Time.Add(-time.Duration(idx)*idm.IntervalDuration - intervalOffset)
 
 		// If the meter has been seen before and we are looking at the same interval.
-		if seen && interval == state.Interval {
+		if seen && interval == state.Interval && !idm.DisableDedup {
 			// Calculate the time difference between the current interval, and
 			// the last interval we know about.
 			diff := state.Time.Sub(intervalTime)
@@ -144,14 +386,43 @@ func (idm IDM) AddPoints(msg LogMessage, eachFn EachFn) {
 		}
 
 		// If the outage bit corresponding to this interval is 1, add it to the field.
-		if (outage>>uint(46-idx))&1 == 1 {
+		if outageBit(outage, idx) {
 			fields["outage"] = int64(1)
 		}
 
+		if idm.Rate {
+			fields["interval_rate"] = float64(usage) / idm.IntervalDuration.Hours()
+		}
+
+		if idm.ChangedOnly && !idm.DisableDedup && !idm.Meters.IntervalChanged(meter, interval, intervalTime, usage, idm.IntervalDuration/2) {
+			continue
+		}
+
 		eachFn(intervalTime, tags, fields)
 	}
 }
 
+// outageFlags converts the outage flags (6 bytes) to uint64 (8 bytes).
+func (idm IDM) outageFlags() uint64 {
+	outageBytes := make([]uint8, 8)
+	copy(outageBytes[2:], idm.Outage)
+	return binary.BigEndian.Uint64(outageBytes)
+}
+
+// outageIntervals is the number of differential intervals covered by the
+// outage flags. The flags are 48 bits, one per interval from the most recent
+// at bit 46 down to the oldest at bit 0. The most significant bit is unused.
+const outageIntervals = 47
+
+// outageBit reports whether the outage flag for the differential interval idx
+// is set. Intervals beyond those covered by the flags never report an outage.
+func outageBit(outage uint64, idx int) bool {
+	if idx < 0 || idx >= outageIntervals {
+		return false
+	}
+	return (outage>>uint(outageIntervals-1-idx))&1 == 1
+}
+
 // SCM handles Standard Consumption Messages from rtlamr.
 type SCM struct {
 	EndpointID   uint32 `json:"ID"`
@@ -159,14 +430,24 @@ type SCM struct {
 	Consumption  uint32 `json:"Consumption"`
 }
 
+// Meter identifies the meter which transmitted the message.
+func (scm SCM) Meter(protocol string) Meter {
+	return Meter{scm.EndpointID, scm.EndpointType, protocol}
+}
+
+// CumulativeConsumption returns the meter's total consumption.
+func (scm SCM) CumulativeConsumption() uint32 {
+	return scm.Consumption
+}
+
+// SetCumulativeConsumption replaces the meter's total consumption.
+func (scm *SCM) SetCumulativeConsumption(consumption uint32) {
+	scm.Consumption = consumption
+}
+
 // AddPoints adds cumulative usage data to a batch of points.
 func (scm SCM) AddPoints(msg LogMessage, eachFn EachFn) {
-	tags := map[string]string{
-		"protocol":      msg.Type,
-		"msg_type":      "cumulative",
-		"endpoint_type": strconv.Itoa(int(scm.EndpointType)),
-		"endpoint_id":   strconv.Itoa(int(scm.EndpointID)),
-	}
+	tags := newTags(msg, "cumulative", scm.EndpointType, scm.EndpointID)
 	fields := map[string]interface{}{
 		"consumption": int64(scm.Consumption),
 	}
@@ -180,14 +461,24 @@ type SCMPlus struct {
 	Consumption  uint32 `json:"Consumption"`
 }
 
+// Meter identifies the meter which transmitted the message.
+func (scmplus SCMPlus) Meter(protocol string) Meter {
+	return Meter{scmplus.EndpointID, scmplus.EndpointType, protocol}
+}
+
+// CumulativeConsumption returns the meter's total consumption.
+func (scmplus SCMPlus) CumulativeConsumption() uint32 {
+	return scmplus.Consumption
+}
+
+// SetCumulativeConsumption replaces the meter's total consumption.
+func (scmplus *SCMPlus) SetCumulativeConsumption(consumption uint32) {
+	scmplus.Consumption = consumption
+}
+
 // AddPoints adds cumulative usage data to a batch of points.
 func (scmplus SCMPlus) AddPoints(msg LogMessage, eachFn EachFn) {
-	tags := map[string]string{
-		"protocol":      msg.Type,
-		"msg_type":      "cumulative",
-		"endpoint_type": strconv.Itoa(int(scmplus.EndpointType)),
-		"endpoint_id":   strconv.Itoa(int(scmplus.EndpointID)),
-	}
+	tags := newTags(msg, "cumulative", scmplus.EndpointType, scmplus.EndpointID)
 	fields := map[string]interface{}{
 		"consumption": int64(scmplus.Consumption),
 	}
@@ -195,26 +486,46 @@ func (scmplus SCMPlus) AddPoints(msg LogMessage, eachFn EachFn) {
 	eachFn(msg.Time, tags, fields)
 }
 
-// R900 handles Neptune R900 messages from rtlamr, both R900 and R900BCD.
+// R900 handles Neptune R900 messages from rtlamr, both R900 and R900BCD. The
+// R900BCD decoder converts consumption from binary-coded decimal before
+// reporting it, so Consumption means the same for both.
 type R900 struct {
+	// Raw enables fields whose meaning is unknown.
+	Raw bool `json:"-"`
+	// GallonsPerUnit scales Consumption to the gallons field.
+	GallonsPerUnit float64 `json:"-"`
+	// Alerts enables boolean fields derived from the leak and backflow flags.
+	Alerts bool `json:"-"`
+
 	EndpointID   uint32 `json:"ID"`
 	EndpointType uint8  `json:"Unkn1"`
 	Consumption  uint32 `json:"Consumption"`
 
 	NoUse    uint8 `json:"NoUse"`    // Day bins of no use
 	BackFlow uint8 `json:"BackFlow"` // Backflow past 35d hi/lo
+	Unkn3    uint8 `json:"Unkn3"`    // Unknown, 2 bits
 	Leak     uint8 `json:"Leak"`     // Day bins of leak
 	LeakNow  uint8 `json:"LeakNow"`  // Leak past 24h hi/lo
 }
 
+// Meter identifies the meter which transmitted the message.
+func (r900 R900) Meter(protocol string) Meter {
+	return Meter{r900.EndpointID, r900.EndpointType, protocol}
+}
+
+// CumulativeConsumption returns the meter's total consumption.
+func (r900 R900) CumulativeConsumption() uint32 {
+	return r900.Consumption
+}
+
+// SetCumulativeConsumption replaces the meter's total consumption.
+func (r900 *R900) SetCumulativeConsumption(consumption uint32) {
+	r900.Consumption = consumption
+}
+
 // AddPoints adds cummulative usage data to a batch of points.
 func (r900 R900) AddPoints(msg LogMessage, eachFn EachFn) {
-	tags := map[string]string{
-		"protocol":      msg.Type,
-		"msg_type":      "cumulative",
-		"endpoint_type": strconv.Itoa(int(r900.EndpointType)),
-		"endpoint_id":   strconv.Itoa(int(r900.EndpointID)),
-	}
+	tags := newTags(msg, "cumulative", r900.EndpointType, r900.EndpointID)
 
 	fields := map[string]interface{}{
 		"consumption": int64(r900.Consumption),
@@ -222,14 +533,153 @@ func (r900 R900) AddPoints(msg LogMessage, eachFn EachFn) {
 		"backflow":    int64(r900.BackFlow),
 		"leak":        int64(r900.Leak),
 		"leak_now":    int64(r900.LeakNow),
+		"gallons":     float64(r900.Consumption) * r900.GallonsPerUnit,
+	}
+
+	// Unkn1 is used as the endpoint type, but nobody knows for sure what it
+	// or Unkn3 mean. Only write them when asked to.
+	if r900.Raw {
+		fields["unkn1"] = int64(r900.EndpointType)
+		fields["unkn3"] = int64(r900.Unkn3)
+	}
+
+	if r900.Alerts {
+		fields["leaking"] = r900.LeakNow > 0
+		fields["backflowing"] = r900.BackFlow > 0
 	}
 
 	eachFn(msg.Time, tags, fields)
 }
 
+// staticTags are added to every point. They are populated from
+// COLLECT_STATIC_TAGS.
+var staticTags = map[string]string{}
+
+// msgTypeNames replaces the cumulative and differential msg_type tag values.
+// It is populated from COLLECT_MSGTYPE_CUMULATIVE and
+// COLLECT_MSGTYPE_DIFFERENTIAL.
+var msgTypeNames = map[string]string{}
+
+// msgTypeName returns the msg_type tag value written for msgType.
+func msgTypeName(msgType string) string {
+	if name, ok := msgTypeNames[msgType]; ok {
+		return name
+	}
+	return msgType
+}
+
+// idRanges add the group tag to points from meters whose endpoint id is in
+// one of them, the first if several match. They are populated from
+// COLLECT_ID_RANGES.
+var idRanges []IDRange
+
+// decodeEndpointType adds the endpoint_type_name tag to every point. It is
+// populated from COLLECT_DECODE_ENDPOINT_TYPE.
+var decodeEndpointType bool
+
+// channelTag adds the channel tag to points from messages reporting one. It is
+// populated from COLLECT_CHANNEL_TAG.
+var channelTag bool
+
+// ertTypes maps ERT endpoint types to the commodity they measure.
+var ertTypes = map[uint8]string{
+	2:  "gas",
+	3:  "water",
+	4:  "electric",
+	5:  "electric",
+	7:  "electric",
+	8:  "electric",
+	9:  "gas",
+	11: "water",
+	12: "gas",
+	13: "water",
+}
+
+// endpointTypeName returns the commodity a meter measures, if known.
+func endpointTypeName(protocol string, endpointType uint8) (name string, ok bool) {
+	switch protocol {
+	case "R900", "R900BCD":
+		// Neptune R900 endpoints are all water meters.
+		return "water", true
+	case "SCM", "IDM", "NetIDM":
+		name, ok = ertTypes[endpointType]
+	}
+	return name, ok
+}
+
+// newTags returns the tags common to all messages. Static tags never override
+// the built-in tags.
+func newTags(msg LogMessage, msgType string, endpointType uint8, endpointID uint32) map[string]string {
+	tags := map[string]string{}
+	for k, v := range staticTags {
+		tags[k] = v
+	}
+
+	tags["protocol"] = msg.Type
+	tags["msg_type"] = msgTypeName(msgType)
+	tags["endpoint_type"] = strconv.Itoa(int(endpointType))
+	tags["endpoint_id"] = strconv.Itoa(int(endpointID))
+
+	for _, r := range idRanges {
+		if endpointID >= r.Min && endpointID <= r.Max {
+			tags["group"] = r.Group
+			break
+		}
+	}
+
+	if decodeEndpointType {
+		name, ok := endpointTypeName(msg.Type, endpointType)
+		if !ok {
+			name = tags["endpoint_type"]
+		}
+		tags["endpoint_type_name"] = name
+	}
+
+	if channelTag && len(msg.Channel) > 0 && string(msg.Channel) != "null" {
+		tags["channel"] = strings.Trim(string(msg.Channel), `"`)
+	}
+
+	return tags
+}
+
+// fieldMap renames fields on every point. It is populated from
+// COLLECT_FIELD_MAP.
+var fieldMap = map[string]string{}
+
+// floatFields writes every integer field as a float. It is populated from
+// COLLECT_NUMERIC_TYPE.
+var floatFields bool
+
+// newPoint builds a point, renaming fields according to fieldMap and
+// converting integers to floats if floatFields is set. Unmapped fields keep
+// their default names.
+func newPoint(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) *write.Point {
+	if len(fieldMap) > 0 || floatFields {
+		converted := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			if name, ok := fieldMap[k]; ok {
+				k = name
+			}
+			if i, ok := v.(int64); ok && floatFields {
+				v = float64(i)
+			}
+			converted[k] = v
+		}
+		fields = converted
+	}
+	return write.NewPoint(measurement, tags, fields, t)
+}
+
 // Message knows how to add points to a batch of points.
 type Message interface {
 	AddPoints(LogMessage, EachFn)
+	Meter(protocol string) Meter
+}
+
+// Cumulative messages report a meter's total consumption.
+type Cumulative interface {
+	CumulativeConsumption() uint32
+	SetCumulativeConsumption(uint32)
 }
 
 type EachFn func(t time.Time, tags map[string]string, fields map[string]interface{})
@@ -240,28 +690,129 @@ type Meter struct {
 	Protocol     string
 }
 
-// LastMessage represents a meter's last interval and time.
+// LastMessage represents a meter's last interval and time, or the last
+// reading of a cumulative meter.
 type LastMessage struct {
 	Time     time.Time
 	Interval uint
+	Outage   bool
+
+	// Consumption and Max are those of the last Reading, valid if
+	// HasConsumption. State written by older versions lacks them.
+	Consumption    uint32
+	Max            uint32
+	HasConsumption bool
 }
 
 // MeterMap keeps meter state to avoid sending duplicate data to the database.
+// State is only kept in memory if db is nil.
 type MeterMap struct {
 	db *bbolt.DB
+
+	// mu guards m, dirty and readings, which may be accessed concurrently.
+	// The other maps are only accessed while processing messages in order.
+	mu *sync.RWMutex
 	m  map[Meter]LastMessage
+
+	// dirty are meters whose state in m hasn't been written to db yet.
+	dirty map[Meter]bool
+
+	// seen is the time each meter was last heard from, kept only in memory.
+	seen map[Meter]time.Time
+
+	// written is the time of each meter's last written message, kept only
+	// in memory.
+	written map[Meter]time.Time
+
+	// intervals are the consumption of each differential meter's intervals,
+	// by interval number, kept only in memory.
+	intervals map[Meter]map[uint]intervalUsage
+
+	// readings are the last reading of each cumulative meter. Their time and
+	// consumption are also kept in m, so they survive restarts.
+	readings map[Meter]Reading
+}
+
+// intervalUsage is the consumption of a differential interval starting at Time.
+type intervalUsage struct {
+	Time        time.Time
+	Consumption uint16
+}
+
+// Reading is a cumulative meter's consumption at a point in time.
+type Reading struct {
+	Time        time.Time
+	Consumption uint32
+
+	// Rate is the exponential moving average of consumption per second, valid
+	// if HasRate.
+	Rate    float64
+	HasRate bool
+
+	// Max is the highest consumption seen, used by COLLECT_MONOTONIC.
+	Max uint32
+}
+
+// isReset reports whether a cumulative meter's consumption dropped from last
+// to less than half, as when a meter is replaced. Smaller drops are more
+// likely to be decoding errors.
+func isReset(last, reading Reading) bool {
+	return reading.Consumption < last.Consumption/2
+}
+
+// smoothRate updates reading's moving average rate from the previous reading,
+// weighting the instantaneous rate by alpha. Readings which go backwards or
+// don't advance in time leave the rate unknown.
+func smoothRate(reading *Reading, last Reading, alpha float64) {
+	dt := reading.Time.Sub(last.Time).Seconds()
+	if dt <= 0 || reading.Consumption < last.Consumption {
+		return
+	}
+
+	rate := float64(reading.Consumption-last.Consumption) / dt
+	if last.HasRate {
+		rate = alpha*rate + (1-alpha)*last.Rate
+	}
+
+	reading.Rate = rate
+	reading.HasRate = true
 }
 
-func NewMeterMap(filename string) (m MeterMap, err error) {
+// NewMeterMap opens the state database filename, loading the last message of
+// each meter. With noSync, writes to the database aren't synced to disk. If
+// filename is empty, no database is opened.
+func NewMeterMap(filename string, noSync bool) (m MeterMap, err error) {
 	m = MeterMap{
-		m: map[Meter]LastMessage{},
+		mu:        &sync.RWMutex{},
+		m:         map[Meter]LastMessage{},
+		dirty:     map[Meter]bool{},
+		seen:      map[Meter]time.Time{},
+		written:   map[Meter]time.Time{},
+		intervals: map[Meter]map[uint]intervalUsage{},
+		readings:  map[Meter]Reading{},
 	}
 
-	m.db, err = bbolt.Open(filename, 0600, nil)
+	if filename == "" {
+		return m, nil
+	}
+
+	m.db, err = bbolt.Open(filename, 0600, &bbolt.Options{
+		NoSync:         noSync,
+		NoFreelistSync: noSync,
+	})
 	if err != nil {
 		return m, xerrors.Errorf("bbolt.Open: %w", err)
 	}
 
+	if err := m.load(); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// load reads the last message of each meter from the database.
+func (m *MeterMap) load() (err error) {
 	err = m.db.View(func(tx *bbolt.Tx) error {
 		bkt := tx.Bucket([]byte("meters"))
 		if bkt == nil {
@@ -285,6 +836,13 @@ func NewMeterMap(filename string) (m MeterMap, err error) {
 			}
 
 			m.m[meter] = msg
+			if msg.HasConsumption {
+				m.readings[meter] = Reading{
+					Time:        msg.Time,
+					Consumption: msg.Consumption,
+					Max:         msg.Max,
+				}
+			}
 
 			return nil
 		})
@@ -292,188 +850,1263 @@ func NewMeterMap(filename string) (m MeterMap, err error) {
 		return nil
 	})
 	if err != nil {
-		return m, xerrors.Errorf("m.db.View: %w", err)
+		return xerrors.Errorf("m.db.View: %w", err)
 	}
 
-	return m, nil
+	return nil
 }
 
-func (m *MeterMap) Update(meter Meter, msg LastMessage) (err error) {
-	err = m.db.Update(func(tx *bbolt.Tx) error {
-		tx.OnCommit(func() {
-			m.m[meter] = msg
-		})
+// EachLast calls fn with the last message of each meter with state.
+func (m *MeterMap) EachLast(fn func(meter Meter, msg LastMessage)) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-		bkt, err := tx.CreateBucketIfNotExists([]byte("meters"))
-		if err != nil {
-			return xerrors.Errorf("tx.CreateBucketIfNotExists: %w", err)
-		}
+	for meter, msg := range m.m {
+		fn(meter, msg)
+	}
+}
 
-		key, err := msgpack.Marshal(meter)
-		if err != nil {
-			return xerrors.Errorf("msgpack.Marshal: %w", err)
-		}
+// Seen records t as the last time meter was heard from, returning the
+// previous time if there is one.
+func (m *MeterMap) Seen(meter Meter, t time.Time) (prev time.Time, ok bool) {
+	prev, ok = m.seen[meter]
+	m.seen[meter] = t
+	return prev, ok
+}
 
-		val, err := msgpack.Marshal(msg)
-		if err != nil {
-			return xerrors.Errorf("msgpack.Marshal: %w", err)
-		}
+// LastWritten returns the time of the meter's last written message, if any.
+func (m *MeterMap) LastWritten(meter Meter) (t time.Time, ok bool) {
+	t, ok = m.written[meter]
+	return t, ok
+}
 
-		err = bkt.Put(key, val)
-		if err != nil {
-			return xerrors.Errorf("bkt.Put: %w", err)
-		}
+// SetWritten records the time of the meter's last written message.
+func (m *MeterMap) SetWritten(meter Meter, t time.Time) {
+	m.written[meter] = t
+}
 
-		return nil
-	})
-	if err != nil {
-		return xerrors.Errorf("m.db.View: %w", err)
+// IntervalChanged records the consumption of the meter's interval starting
+// at t, reporting whether it differs from that previously recorded for the
+// same interval. Intervals are the same if their numbers match and their
+// times are less than window apart, since interval numbers wrap around.
+func (m *MeterMap) IntervalChanged(meter Meter, interval uint, t time.Time, consumption uint16, window time.Duration) bool {
+	intervals, ok := m.intervals[meter]
+	if !ok {
+		intervals = map[uint]intervalUsage{}
+		m.intervals[meter] = intervals
 	}
 
-	return nil
-}
-
-func lookupEnv(name string, dryRun bool) string {
-	val, ok := os.LookupEnv(name)
-	if !ok && !dryRun {
-		log.Fatalf("%q undefined\n", name)
+	prev, ok := intervals[interval]
+	intervals[interval] = intervalUsage{t, consumption}
+	if !ok || prev.Consumption != consumption {
+		return true
 	}
-	return val
+
+	diff := t.Sub(prev.Time)
+	return diff <= -window || diff >= window
 }
 
-func init() {
-	_, f, _, _ := runtime.Caller(0)
-	dir := filepath.Dir(f) + "\\"
+// LastReading returns the last reading of a cumulative meter, if any.
+func (m *MeterMap) LastReading(meter Meter) (reading Reading, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	log.SetFormatter(&log.TextFormatter{
-		ForceColors:     true,
-		FullTimestamp:   true,
-		TimestampFormat: "2006-01-02 15:04:05.999",
-		CallerPrettyfier: func(frame *runtime.Frame) (fn, file string) {
-			file = strings.TrimPrefix(filepath.Clean(frame.File), dir)
-			return frame.Function, fmt.Sprintf("%s:%d", file, frame.Line)
-		},
-	})
-	log.SetReportCaller(true)
+	reading, ok = m.readings[meter]
+	return reading, ok
 }
 
-func main() {
-	// COLLECT_INFLUXDB_STRICTIDM limits which endpoint types may be decoded
-	// between IDM and NetIDM. In the wild, type 7 should be standard IDM and
-	// type 8 should be NetIDM. Both messages have the same preamble and
-	// checksum, so they are picked up by both decoders, but have different
-	// internal field layout.
-	_, strict := os.LookupEnv("COLLECT_STRICTIDM")
-	_, dryRun := os.LookupEnv("COLLECT_INFLUXDB_DRYRUN")
-
-	// One of Panic, Fatal, Error, Warn, Info, Debug, Trace. Defaults to Info.
-	levelStr, _ := os.LookupEnv("COLLECT_LOGLEVEL")
-	level, err := log.ParseLevel(levelStr)
-	if err == nil {
-		log.SetLevel(level)
-	}
+// SetReading records the latest reading of a cumulative meter. Its time and
+// consumption are written to the database like Update.
+func (m *MeterMap) SetReading(meter Meter, reading Reading) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	hostname := lookupEnv("COLLECT_INFLUXDB_HOSTNAME", dryRun)
-	token := lookupEnv("COLLECT_INFLUXDB_TOKEN", dryRun)
-	org := lookupEnv("COLLECT_INFLUXDB_ORG", dryRun)
-	bucket := lookupEnv("COLLECT_INFLUXDB_BUCKET", dryRun)
-	measurement := lookupEnv("COLLECT_INFLUXDB_MEASUREMENT", dryRun)
+	m.readings[meter] = reading
 
-	opts := influxdb2.DefaultOptions()
+	msg := m.m[meter]
+	msg.Time = reading.Time
+	msg.Consumption = reading.Consumption
+	msg.Max = reading.Max
+	msg.HasConsumption = true
 
-	clientCertFile, ok := os.LookupEnv("COLLECT_INFLUXDB_CLIENT_CERT")
-	if ok && !dryRun {
-		clientKeyFile := lookupEnv("COLLECT_INFLUXDB_CLIENT_KEY", dryRun)
-		clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
-		if err != nil {
-			log.Fatalf("could not load client certificate: %s\n", err)
-		}
+	m.m[meter] = msg
+	m.dirty[meter] = true
 
-		opts.SetTLSConfig(&tls.Config{
-			Certificates: []tls.Certificate{clientCert},
-		})
+	if len(m.dirty) < stateFlushUpdates {
+		return nil
 	}
+	return m.flush()
+}
 
-	mm, err := NewMeterMap("meters.db")
-	if err != nil {
-		log.Fatalf("%+v\n", xerrors.Errorf("NewMeterMap: %w", err))
+// EachSeen calls fn with the last time each meter was heard from.
+func (m *MeterMap) EachSeen(fn func(meter Meter, t time.Time)) {
+	for meter, t := range m.seen {
+		fn(meter, t)
 	}
-	defer mm.db.Close()
+}
 
-	var client influxdb2.Client
+// stateFlushUpdates is the number of meters with unwritten state at which
+// Update writes them to the database. Remaining state is written by Flush,
+// called every stateFlushInterval.
+const (
+	stateFlushUpdates  = 64
+	stateFlushInterval = 30 * time.Second
+)
 
-	if !dryRun {
-		log.Printf("connecting to %q", hostname)
-	}
-	client = influxdb2.NewClientWithOptions(hostname, token, opts)
-	defer client.Close()
+// Last returns the meter's last message, if any.
+func (m *MeterMap) Last(meter Meter) (msg LastMessage, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	// Create a blocking write api.
-	api := client.WriteAPIBlocking(org, bucket)
+	msg, ok = m.m[meter]
+	return msg, ok
+}
 
-	// Read lines from stdin.
-	stdinBuf := bufio.NewScanner(os.Stdin)
-	for stdinBuf.Scan() {
-		line := stdinBuf.Bytes()
-		log.Trace(string(line))
+// Update records the meter's last message. State is written to the database
+// in batches, see stateFlushUpdates.
+func (m *MeterMap) Update(meter Meter, msg LastMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		// Parse a log message.
-		var logMsg LogMessage
-		err := json.Unmarshal(line, &logMsg)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
+	m.m[meter] = msg
+	m.dirty[meter] = true
 
-		// Store the appropriate message type in msg based on logMsg.Type.
-		var msg Message
-		switch logMsg.Type {
-		case "SCM":
-			msg = new(SCM)
-		case "SCM+":
-			msg = new(SCMPlus)
-		case "IDM", "NetIDM":
-			msg = new(IDM)
-		case "R900", "R900BCD":
-			msg = new(R900)
-		}
+	if len(m.dirty) < stateFlushUpdates {
+		return nil
+	}
+	return m.flush()
+}
 
-		// Parse the encapsulated message.
-		err = json.Unmarshal(logMsg.Message, msg)
-		if err != nil {
-			log.Println(errors.Wrap(err, "json unmarshal"))
-			continue
-		}
+// Flush writes all unwritten state to the database in a single transaction.
+func (m *MeterMap) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		// If current message is an IDM.
-		if idm, ok := msg.(*IDM); ok {
-			// Store meter state for discarding duplicate data.
-			idm.Meters = mm
+	return m.flush()
+}
+
+func (m *MeterMap) flush() error {
+	if m.db == nil {
+		for meter := range m.dirty {
+			delete(m.dirty, meter)
+		}
+		return nil
+	}
+	if len(m.dirty) == 0 {
+		return nil
+	}
+
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte("meters"))
+		if err != nil {
+			return xerrors.Errorf("tx.CreateBucketIfNotExists: %w", err)
+		}
+
+		for meter := range m.dirty {
+			key, err := msgpack.Marshal(meter)
+			if err != nil {
+				return xerrors.Errorf("msgpack.Marshal: %w", err)
+			}
+
+			val, err := msgpack.Marshal(m.m[meter])
+			if err != nil {
+				return xerrors.Errorf("msgpack.Marshal: %w", err)
+			}
+
+			err = bkt.Put(key, val)
+			if err != nil {
+				return xerrors.Errorf("bkt.Put: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("m.db.Update: %w", err)
+	}
+
+	for meter := range m.dirty {
+		delete(m.dirty, meter)
+	}
+	return nil
+}
+
+// Close writes any unwritten state and closes the database.
+func (m *MeterMap) Close() error {
+	if m.db == nil {
+		return nil
+	}
+	if err := m.Flush(); err != nil {
+		m.db.Close()
+		return xerrors.Errorf("m.Flush: %w", err)
+	}
+	if err := m.db.Close(); err != nil {
+		return xerrors.Errorf("m.db.Close: %w", err)
+	}
+	return nil
+}
+
+// requiredFields lists the json fields each protocol must include when
+// COLLECT_STRICT_FIELDS is defined.
+var requiredFields = map[string][]string{
+	"SCM":     {"ID", "Type", "Consumption"},
+	"SCM+":    {"EndpointID", "EndpointType", "Consumption"},
+	"IDM":     {"ERTType", "ERTSerialNumber", "TransmitTimeOffset", "ConsumptionIntervalCount", "DifferentialConsumptionIntervals", "LastConsumptionCount"},
+	"NetIDM":  {"ERTType", "ERTSerialNumber", "TransmitTimeOffset", "ConsumptionIntervalCount", "DifferentialConsumptionIntervals", "LastConsumption", "LastConsumptionNet", "LastGeneration"},
+	"R900":    {"ID", "Unkn1", "Consumption"},
+	"R900BCD": {"ID", "Unkn1", "Consumption"},
+}
+
+// missingFields returns the required fields absent or null in a message.
+func missingFields(protocol string, message json.RawMessage) (missing []string, err error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, name := range requiredFields[protocol] {
+		if val, ok := fields[name]; !ok || string(val) == "null" {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing, nil
+}
+
+// protocolSuffix maps protocol names to the suffix of their environment
+// variables, e.g. COLLECT_INFLUXDB_MEASUREMENT_SCMPLUS.
+var protocolSuffix = map[string]string{
+	"SCM":     "SCM",
+	"SCM+":    "SCMPLUS",
+	"IDM":     "IDM",
+	"NetIDM":  "NETIDM",
+	"R900":    "R900",
+	"R900BCD": "R900BCD",
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(s string) (map[string]string, error) {
+	kv := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		idx := strings.Index(pair, "=")
+		if idx <= 0 {
+			return nil, xerrors.Errorf("invalid pair %q, expected key=value", pair)
+		}
+
+		kv[strings.TrimSpace(pair[:idx])] = strings.TrimSpace(pair[idx+1:])
+	}
+	return kv, nil
+}
+
+// defaultMaxLineBytes is the longest line read unless COLLECT_MAX_LINE_BYTES
+// is defined.
+const defaultMaxLineBytes = 1 << 20
+
+// Line is a line of input read from source.
+type Line struct {
+	Source   string
+	Data     []byte
+	Received time.Time
+
+	// Err is the error which stopped reading source, if Data is nil.
+	Err error
+}
+
+// readLines sends each line read from r to lines until r is exhausted or done
+// is closed, returning any error other than io.EOF. Lines longer than
+// maxLineBytes are skipped. Lines holding a JSON array are sent as one line
+// per element.
+func readLines(r io.Reader, source string, maxLineBytes int, lines chan<- Line, done <-chan struct{}) error {
+	scanner := newLineScanner(r, maxLineBytes)
+	for scanner.Scan() {
+		// The scanner re-uses its buffer, so each line must be copied.
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+
+		received := time.Now()
+		for _, elem := range splitArray(line) {
+			select {
+			case lines <- Line{Source: source, Data: elem, Received: received}:
+			case <-done:
+				return nil
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return xerrors.Errorf("scanner.Scan: %w", err)
+	}
+	return nil
+}
+
+// newLineScanner returns a scanner of the lines read from r which skips, and
+// logs, lines longer than maxLineBytes.
+func newLineScanner(r io.Reader, maxLineBytes int) *bufio.Scanner {
+	// The scanner's limit is the larger of maxLineBytes and the initial
+	// buffer's capacity.
+	size := 4096
+	if maxLineBytes < size {
+		size = maxLineBytes
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, size), maxLineBytes)
+	scanner.Split(scanLinesLimited(maxLineBytes, func(n int) {
+		log.Warnf("skipped line of %d bytes, longer than COLLECT_MAX_LINE_BYTES (%d)", n, maxLineBytes)
+	}))
+	return scanner
+}
+
+// splitArray returns the elements of line if it is a JSON array, for
+// producers which batch messages. Any other line, including an array which
+// fails to parse, is returned as is so the error is reported when decoding.
+func splitArray(line []byte) [][]byte {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return [][]byte{line}
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elems); err != nil {
+		return [][]byte{line}
+	}
+
+	split := make([][]byte, len(elems))
+	for idx, elem := range elems {
+		split[idx] = elem
+	}
+	return split
+}
+
+// paceLines forwards lines to out, delaying each so the time between lines is
+// the time between their messages' timestamps divided by speed. Lines which
+// fail to parse or are older than the first message aren't delayed. It returns
+// after forwarding a line without data, or once done is closed.
+func paceLines(lines <-chan Line, out chan<- Line, speed float64, format string, done <-chan struct{}) {
+	var firstMsg, firstWall time.Time
+	for line := range lines {
+		if line.Data == nil {
+			select {
+			case out <- line:
+			case <-done:
+			}
+			return
+		}
+
+		var logMsg LogMessage
+		var err error
+		if format == "csv" {
+			logMsg, err = parseCSV(line.Data)
+		} else {
+			err = json.Unmarshal(line.Data, &logMsg)
+		}
+
+		if err == nil {
+			if firstMsg.IsZero() {
+				firstMsg, firstWall = logMsg.Time, time.Now()
+			}
+
+			offset := time.Duration(float64(logMsg.Time.Sub(firstMsg)) / speed)
+			if wait := time.Until(firstWall.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+			line.Received = time.Now()
+		}
+
+		select {
+		case out <- line:
+		case <-done:
+			return
+		}
+	}
+}
+
+// scanLinesLimited splits lines like bufio.ScanLines, but discards lines
+// which would fill a buffer of max bytes instead of failing with
+// bufio.ErrTooLong. skipped is called with the length of each discarded line.
+// The line following a discarded one is split in the same call, since the
+// scanner reads more before splitting again and a socket may not send any.
+func scanLinesLimited(max int, skipped func(n int)) bufio.SplitFunc {
+	discarded := 0
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		consumed := 0
+		if discarded > 0 {
+			idx := bytes.IndexByte(data, '\n')
+			switch {
+			case idx >= 0:
+				skipped(discarded + idx)
+				discarded = 0
+				consumed, data = idx+1, data[idx+1:]
+			case atEOF:
+				skipped(discarded + len(data))
+				discarded = 0
+				return len(data), nil, nil
+			default:
+				discarded += len(data)
+				return len(data), nil, nil
+			}
+		}
+
+		if bytes.IndexByte(data, '\n') < 0 && len(data) >= max {
+			discarded += len(data)
+			return consumed + len(data), nil, nil
+		}
+
+		advance, token, err = bufio.ScanLines(data, atEOF)
+		return consumed + advance, token, err
+	}
+}
+
+// ErrorLimiter logs at most one error per interval, counting the rest so a
+// stream of malformed input doesn't flood the log.
+type ErrorLimiter struct {
+	Interval time.Duration
+
+	start      time.Time
+	suppressed int
+}
+
+// Log logs err unless another error was logged within the interval. The
+// number of suppressed errors is logged when the interval has elapsed.
+func (l *ErrorLimiter) Log(err error) {
+	now := time.Now()
+	if now.Sub(l.start) < l.Interval {
+		l.suppressed++
+		return
+	}
+
+	if l.suppressed > 0 {
+		log.Warnf("%d parse errors suppressed in last %s", l.suppressed, now.Sub(l.start).Round(time.Second))
+	}
+
+	l.start = now
+	l.suppressed = 0
+	log.Println(err)
+}
+
+func init() {
+	_, f, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(f) + "\\"
+
+	log.SetFormatter(&log.TextFormatter{
+		ForceColors:     true,
+		FullTimestamp:   true,
+		TimestampFormat: "2006-01-02 15:04:05.999",
+		CallerPrettyfier: func(frame *runtime.Frame) (fn, file string) {
+			file = strings.TrimPrefix(filepath.Clean(frame.File), dir)
+			return frame.Function, fmt.Sprintf("%s:%d", file, frame.Line)
+		},
+	})
+	log.SetReportCaller(true)
+}
+
+// openLogFile directs the log to a file rotated by size, configured by
+// COLLECT_LOG_MAX_SIZE and COLLECT_LOG_MAX_BACKUPS.
+func openLogFile(filename string) (*RotatingFile, error) {
+	f, err := OpenRotatingFile(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("OpenRotatingFile: %w", err)
+	}
+
+	f.MaxSize = 10 << 20
+	if val, ok := os.LookupEnv("COLLECT_LOG_MAX_SIZE"); ok {
+		f.MaxSize, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("COLLECT_LOG_MAX_SIZE: %w", err)
+		}
+	}
+
+	f.MaxBackups = 3
+	if val, ok := os.LookupEnv("COLLECT_LOG_MAX_BACKUPS"); ok {
+		f.MaxBackups, err = strconv.Atoi(val)
+		if err != nil {
+			return nil, xerrors.Errorf("COLLECT_LOG_MAX_BACKUPS: %w", err)
+		}
+	}
+
+	// Colors are only useful on a terminal.
+	if formatter, ok := log.StandardLogger().Formatter.(*log.TextFormatter); ok {
+		formatter.ForceColors = false
+		formatter.DisableColors = true
+	}
+	log.SetOutput(f)
+
+	return f, nil
+}
+
+func main() {
+	var printVersion bool
+	flag.BoolVar(&printVersion, "version", false, "print version and exit")
+	flag.BoolVar(&printVersion, "v", false, "print version and exit (shorthand)")
+	flag.Parse()
+
+	if printVersion {
+		fmt.Println(versionString())
+		return
+	}
 
-			// If COLLECT_INFLUXDB_STRICTIDM is defined, disallow IDM of type 8.
-			if strict && logMsg.Type == "IDM" && idm.EndpointType == 8 {
+	if serviceMain(flag.Args()) {
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "test" {
+		testConnection = true
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "meters" {
+		listMeters(args[1:])
+		return
+	}
+
+	run()
+}
+
+// testConnection checks that a point can be written to InfluxDB and exits
+// instead of processing input. It is set by the test subcommand.
+var testConnection bool
+
+// interrupt receives the signals which stop listening on socket inputs, from
+// the operating system or the Windows service manager.
+var interrupt = make(chan os.Signal, 1)
+
+// run configures the collector from the environment and processes input until
+// it is exhausted.
+func run() {
+	// COLLECT_CONFIG is a YAML or TOML file of environment variables.
+	// Variables defined in the environment take precedence.
+	if filename, ok := os.LookupEnv("COLLECT_CONFIG"); ok {
+		if err := loadConfigFile(filename); err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("loadConfigFile: %w", err))
+		}
+	}
+
+	// One of Panic, Fatal, Error, Warn, Info, Debug, Trace. Defaults to Info.
+	levelStr, _ := os.LookupEnv("COLLECT_LOGLEVEL")
+	level, err := log.ParseLevel(levelStr)
+	if err == nil {
+		log.SetLevel(level)
+	}
+
+	if filename, ok := os.LookupEnv("COLLECT_LOG_FILE"); ok {
+		logFile, err := openLogFile(filename)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("openLogFile: %w", err))
+		}
+		defer logFile.Close()
+	}
+
+	// COLLECT_SELFTEST checks the built-in sample of each protocol decodes as
+	// expected and exits.
+	if _, ok := os.LookupEnv("COLLECT_SELFTEST"); ok {
+		if !selfTest(os.Stdout) {
+			log.Fatal("self-test failed")
+		}
+		log.Println("self-test passed")
+		return
+	}
+
+	cfg, err := NewConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%+v\n", xerrors.Errorf("NewConfigFromEnv: %w", err))
+	}
+	logEnvSummary()
+
+	if cfg.DisableDedup {
+		log.Warn("COLLECT_DISABLE_DEDUP is set, all messages are written including duplicate intervals and readings")
+	}
+
+	timeLocation = cfg.TimeLocation
+	staticTags = cfg.StaticTags
+	fieldMap = cfg.FieldMap
+	jsonKeys = cfg.JSONKeys
+	msgTypeNames = cfg.MsgTypeNames
+	decodeEndpointType = cfg.DecodeEndpointType
+	idRanges = cfg.IDRanges
+	channelTag = cfg.ChannelTag
+	floatFields = cfg.NumericType == "float"
+
+	if testConnection {
+		if err := testInfluxDB(cfg); err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("connection test failed: %w", err))
+		}
+		log.Printf("connection test passed, wrote a point to %q in bucket %q", testMeasurement, cfg.Bucket)
+		return
+	}
+
+	stateFile := "meters.db"
+	if cfg.StateMemory {
+		stateFile = ""
+	}
+
+	mm, err := NewMeterMap(stateFile, cfg.StateNoSync)
+	if err != nil {
+		log.Fatalf("%+v\n", xerrors.Errorf("NewMeterMap: %w", err))
+	}
+	defer func() {
+		if err := mm.Close(); err != nil {
+			log.Errorf("%+v", xerrors.Errorf("mm.Close: %w", err))
+		}
+	}()
+
+	log.Println(versionString())
+
+	var sink Sink
+	switch {
+	case cfg.DryRun:
+		sink = DiscardSink{}
+	case cfg.Output == "stdout":
+		sink = NewLineProtocolSink(os.Stdout)
+	case cfg.Output == "udp":
+		sink, err = NewUDPSink(cfg.UDPAddr)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewUDPSink: %w", err))
+		}
+	case cfg.Output == "ndjson":
+		f, err := OpenRotatingFile(cfg.NDJSONPath)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("OpenRotatingFile: %w", err))
+		}
+		f.MaxSize = cfg.NDJSONMaxSize
+		f.Daily = cfg.NDJSONDaily
+		sink = NewNDJSONSink(f)
+	case cfg.Output == "nats":
+		sink, err = NewNATSSink(cfg.NATSURL, cfg.NATSStream, cfg.PayloadFormat)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewNATSSink: %w", err))
+		}
+	case cfg.Output == "graphite":
+		sink, err = NewGraphiteSink(cfg.GraphiteAddr, cfg.GraphitePrefix)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewGraphiteSink: %w", err))
+		}
+	case cfg.Output == "mqtt":
+		sink, err = NewMQTTSink(cfg.MQTTURL, cfg.MQTTDiscovery, cfg.PayloadFormat)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewMQTTSink: %w", err))
+		}
+	case cfg.Output == "timestream":
+		sink, err = NewTimestreamSink(cfg.TimestreamDatabase, cfg.TimestreamTable, cfg.TimestreamRegion, cfg.TimestreamEndpoint, cfg.AWSCredentials)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewTimestreamSink: %w", err))
+		}
+	case cfg.Output == "influxdb":
+		client, err := newInfluxDBClient(cfg)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("newInfluxDBClient: %w", err))
+		}
+		defer client.Close()
+
+		// Create a blocking write api, used at least to check the connection.
+		api := client.WriteAPIBlocking(cfg.Org, cfg.Bucket)
+
+		// Points are kept in the write-ahead log until an unreachable server
+		// comes back, but a rejected token won't fix itself.
+		err = preflight(client, api, cfg.Bucket)
+		if err != nil && (cfg.WALMax == 0 || authError(err, cfg.Bucket) != nil) {
+			log.Fatalf("%+v\n", xerrors.Errorf("preflight: %w", err))
+		}
+		if err != nil {
+			log.Warnf("%+v", xerrors.Errorf("preflight: %w", err))
+		}
+
+		if cfg.CreateBucket && err == nil {
+			created, err := ensureBucket(client, cfg.Org, cfg.Bucket, cfg.Retention)
+			if err != nil {
+				log.Fatalf("%+v\n", xerrors.Errorf("ensureBucket: %w", err))
+			}
+			if created {
+				log.Printf("created bucket %q", cfg.Bucket)
+			}
+		}
+
+		if cfg.Async {
+			sink = NewAsyncInfluxDBSink(client, client.WriteAPI(cfg.Org, cfg.Bucket), cfg.Bucket)
+		} else {
+			sink = NewInfluxDBSink(client, cfg.Org, cfg.Bucket, cfg.WriteTimeout)
+		}
+	}
+
+	if cfg.WriteRate > 0 {
+		sink = NewRateLimitedSink(sink, cfg.WriteRate, cfg.WriteQueue)
+	}
+	if cfg.WALMax > 0 {
+		sink, err = NewWALSink(sink, "wal.db", cfg.WALMax)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("NewWALSink: %w", err))
+		}
+	}
+	defer sink.Close()
+
+	var inputs []Input
+	switch {
+	case len(cfg.Sources) > 0:
+		sources := make([]string, 0, len(cfg.Sources))
+		for source := range cfg.Sources {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+
+		for _, source := range sources {
+			in, err := OpenInput(source, cfg.Sources[source], cfg.MaxLineBytes)
+			if err != nil {
+				log.Fatalf("%+v\n", xerrors.Errorf("OpenInput: %w", err))
+			}
+			log.Printf("reading source %q from %q", source, cfg.Sources[source])
+
+			inputs = append(inputs, in)
+		}
+	case cfg.ListenUnix != "":
+		unixInput, err := ListenUnix(cfg.ListenUnix, cfg.MaxLineBytes)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("ListenUnix: %w", err))
+		}
+		log.Printf("listening on %q", cfg.ListenUnix)
+
+		inputs = append(inputs, Input{ReadCloser: unixInput})
+	case cfg.InputGzip:
+		gz, err := gzip.NewReader(os.Stdin)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("gzip.NewReader: %w", err))
+		}
+
+		inputs = append(inputs, Input{ReadCloser: gz})
+	default:
+		inputs = append(inputs, Input{ReadCloser: os.Stdin})
+	}
+
+	// Stop listening on interrupt so sockets are removed and the remaining
+	// input is processed before exiting. Other inputs are read until EOF, a
+	// second interrupt exits immediately. With COLLECT_SHUTDOWN_TIMEOUT,
+	// every input is given at most that long after an interrupt before the
+	// process exits regardless.
+	for _, in := range inputs {
+		if _, ok := in.ReadCloser.(*SocketInput); ok || cfg.ShutdownTimeout > 0 {
+			signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		}
+	}
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		for _, in := range inputs {
+			if socket, ok := in.ReadCloser.(*SocketInput); ok {
+				socket.Close()
+			}
+		}
+
+		if cfg.ShutdownTimeout > 0 {
+			time.AfterFunc(cfg.ShutdownTimeout, func() {
+				msg := fmt.Sprintf("shutdown timed out after %s", cfg.ShutdownTimeout)
+				if pender, ok := sink.(Pender); ok {
+					msg += fmt.Sprintf(", %d points not yet written", pender.Pending())
+				}
+				log.Warn(msg)
+
+				if err := mm.Flush(); err != nil {
+					log.Errorf("%+v", xerrors.Errorf("mm.Flush: %w", err))
+				}
+				os.Exit(1)
+			})
+		}
+	}()
+
+	if err := process(inputs, sink, mm, cfg); err != nil {
+		// Fatalf exits without running deferred calls, so state is written
+		// here.
+		if err := mm.Close(); err != nil {
+			log.Errorf("%+v", xerrors.Errorf("mm.Close: %w", err))
+		}
+		log.Fatalf("%+v\n", xerrors.Errorf("process: %w", err))
+	}
+}
+
+// process decodes messages read from inputs and writes their points to sink
+// until every input is exhausted.
+func process(inputs []Input, sink Sink, mm MeterMap, cfg Config) error {
+	// Count lines which parsed and failed to detect input that isn't from
+	// rtlamr at all.
+	var parsed, failed int
+
+	parseErrors := ErrorLimiter{Interval: 10 * time.Second}
+
+	filter := MeterFilter{Known: cfg.KnownMeters, Max: cfg.MaxSeries}
+	resolver := IDMResolver{}
+
+	var webhook *Webhook
+	if cfg.WebhookURL != "" {
+		webhook = NewWebhook(cfg.WebhookURL, cfg.WebhookInterval)
+		defer webhook.Wait()
+	}
+	dups := DupFilter{Window: cfg.DupWindow}
+	buckets := BucketFilter{Bucket: cfg.DedupBucket}
+
+	// Every line received is appended to the raw log with the time it was
+	// received.
+	var rawLog *RotatingFile
+	if cfg.RawLog != "" {
+		var err error
+		rawLog, err = OpenRotatingFile(cfg.RawLog)
+		if err != nil {
+			return xerrors.Errorf("OpenRotatingFile: %w", err)
+		}
+		defer rawLog.Close()
+
+		rawLog.MaxSize = cfg.RawLogMaxSize
+		rawLog.Daily = cfg.RawLogDaily
+	}
+
+	var staleTick <-chan time.Time
+	if cfg.StaleMeasurement != "" {
+		ticker := time.NewTicker(cfg.StaleInterval)
+		defer ticker.Stop()
+		staleTick = ticker.C
+	}
+
+	// Ping sinks which support it when nothing has been written for the
+	// keepalive interval.
+	var keepaliveTick <-chan time.Time
+	pinger, ok := sink.(Pinger)
+	if cfg.KeepaliveInterval > 0 && ok {
+		ticker := time.NewTicker(cfg.KeepaliveInterval)
+		defer ticker.Stop()
+		keepaliveTick = ticker.C
+	}
+	lastWrite := time.Now()
+
+	stateTicker := time.NewTicker(stateFlushInterval)
+	defer stateTicker.Stop()
+
+	// Stop once no line has been received for the idle timeout, for fixed
+	// captures and upstream processes which die without closing the pipe.
+	var idleTimer *time.Timer
+	var idleTimeout <-chan time.Time
+	if cfg.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(cfg.IdleTimeout)
+		defer idleTimer.Stop()
+		idleTimeout = idleTimer.C
+	}
+
+	// Log a summary of activity every stats interval.
+	stats := NewStats()
+	var statsTick <-chan time.Time
+	if cfg.StatsInterval > 0 {
+		ticker := time.NewTicker(cfg.StatsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
+	// Points are coalesced for the batch window before being written, so
+	// meters transmitting close together share a single write.
+	var batch []*write.Point
+	var batchTimer <-chan time.Time
+
+	flush := func() error {
+		batchTimer = nil
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := sink.WritePoints(batch)
+		n := len(batch)
+		batch = nil
+		if err != nil {
+			return xerrors.Errorf("sink.WritePoints: %w", err)
+		}
+		stats.Written(n)
+		lastWrite = time.Now()
+		return nil
+	}
+
+	writePoints := func(pts []*write.Point) error {
+		if len(pts) == 0 {
+			return nil
+		}
+		batch = append(batch, pts...)
+		if cfg.BatchWindow == 0 {
+			return flush()
+		}
+		if batchTimer == nil {
+			batchTimer = time.After(cfg.BatchWindow)
+		}
+		return nil
+	}
+
+	// Closing done stops the goroutines reading and decoding lines once
+	// process returns, whether or not the inputs were exhausted.
+	done := make(chan struct{})
+	defer close(done)
+
+	lines := make(chan Line)
+	// Each input sends a line without data once it stops on error or EOF.
+	// Inputs other than sockets are paced by their timestamps when
+	// replaying.
+	for _, in := range inputs {
+		go func(in Input) {
+			out := lines
+			if _, ok := in.ReadCloser.(*SocketInput); !ok && cfg.ReplaySpeed > 0 {
+				paced := make(chan Line)
+				go paceLines(paced, lines, cfg.ReplaySpeed, cfg.InputFormat, done)
+				out = paced
+			}
+
+			err := readLines(in, in.Source, cfg.MaxLineBytes, out, done)
+			select {
+			case out <- Line{Source: in.Source, Err: err}:
+			case <-done:
+			}
+		}(in)
+	}
+	remaining := len(inputs)
+
+	decode := func(line Line) (d Decoded) {
+		d.Line = line
+		if line.Data == nil {
+			return d
+		}
+
+		if cfg.InputFormat == "csv" {
+			d.LogMsg, d.ParseErr = parseCSV(line.Data)
+		} else {
+			d.ParseErr = json.Unmarshal(line.Data, &d.LogMsg)
+		}
+		if d.ParseErr == nil {
+			d.Msg, d.DecodeErr = decodeMessage(d.LogMsg, mm, cfg)
+		}
+		return d
+	}
+
+	// With more than one worker, lines are decoded concurrently and
+	// everything else happens in the order lines were received. Otherwise
+	// lines are decoded as they are received.
+	var decoded chan Decoded
+	undecoded := lines
+	if cfg.Workers > 1 {
+		decoded = make(chan Decoded)
+		go decodeLines(lines, decoded, cfg.Workers, decode, done)
+		undecoded = nil
+	}
+
+	for {
+		var d Decoded
+		select {
+		case line := <-undecoded:
+			d = decode(line)
+		case d = <-decoded:
+		case <-batchTimer:
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		case now := <-staleTick:
+			pts := []*write.Point{}
+			mm.EachSeen(func(meter Meter, t time.Time) {
+				tags := newTags(LogMessage{Type: meter.Protocol}, "status", meter.EndpointType, meter.EndpointID)
+				fields := map[string]interface{}{
+					"seconds_since_last_seen": int64(now.Sub(t) / time.Second),
+				}
+				pts = append(pts, newPoint(cfg.StaleMeasurement, tags, fields, now))
+			})
+
+			if err := writePoints(pts); err != nil {
+				return err
+			}
+			continue
+		case now := <-keepaliveTick:
+			if now.Sub(lastWrite) < cfg.KeepaliveInterval {
 				continue
 			}
+			if err := pinger.Ping(); err != nil {
+				log.Warnf("keepalive: %+v", err)
+				continue
+			}
+			log.Debug("keepalive")
+			lastWrite = now
+			continue
+		case <-stateTicker.C:
+			if err := mm.Flush(); err != nil {
+				log.Warnf("%+v", xerrors.Errorf("mm.Flush: %w", err))
+			}
+			continue
+		case <-statsTick:
+			log.Infof("stats: %s", stats)
+			if cfg.StatsReset {
+				stats = NewStats()
+			}
+			continue
+		case <-idleTimeout:
+			log.Infof("no input received for %s, exiting", cfg.IdleTimeout)
+			return flush()
+		}
+		line, logMsg, msg := d.Line, d.LogMsg, d.Msg
+		if idleTimer != nil && line.Data != nil {
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(cfg.IdleTimeout)
+		}
+		if line.Data == nil {
+			if line.Err != nil {
+				if err := flush(); err != nil {
+					return err
+				}
+				return xerrors.Errorf("readLines: %w", line.Err)
+			}
+
+			remaining--
+			if remaining > 0 {
+				continue
+			}
+			return flush()
+		}
+		log.Trace(string(line.Data))
+
+		if rawLog != nil {
+			received := line.Received.UTC().Format(time.RFC3339Nano)
+			if _, err := fmt.Fprintf(rawLog, "%s\t%s\n", received, line.Data); err != nil {
+				log.Warnf("raw log: %+v", err)
+			}
+		}
+
+		if err := d.ParseErr; err != nil {
+			failed++
+			if parsed == 0 && failed >= probeLines {
+				return xerrors.Errorf("input does not appear to be rtlamr %s, did you set RTLAMR_FORMAT=%s? last error: %w", cfg.InputFormat, cfg.InputFormat, err)
+			}
+
+			parseErrors.Log(err)
+			continue
+		}
+		parsed++
+
+		if d.DecodeErr != nil {
+			parseErrors.Log(d.DecodeErr)
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+
+		// Hosts without a reliable clock may timestamp messages with the
+		// time they were received instead.
+		if cfg.Timestamp == "receive" {
+			logMsg.Time = line.Received
+		}
+
+		meter := msg.Meter(logMsg.Type)
+		if !resolver.Allow(meter) {
+			log.Debugf("dropped %s message from %d, meter is resolved as the other interpretation", meter.Protocol, meter.EndpointID)
+			continue
+		}
+		if !filter.Allow(meter) {
+			continue
+		}
+
+		// Only meters which passed the filters are remembered, otherwise the
+		// stale measurement would write a series for each of them.
+		prev, seen := mm.Seen(meter, logMsg.Time)
+		stats.Message(meter)
 
-			// If COLLECT_INFLUXDB_STRICTIDM is defined, disallow NetIDM of type 7.
-			if strict && logMsg.Type == "NetIDM" && idm.EndpointType == 7 {
+		// Drop copies of a single transmission, e.g. due to multipath.
+		if !cfg.DisableDedup && dups.Duplicate(meter, logMsg.Message, logMsg.Time) {
+			log.Debugf("dropped duplicate message from %d (%s)", meter.EndpointID, meter.Protocol)
+			continue
+		}
+
+		// Write at most one message per meter every MinInterval.
+		if interval := cfg.MinIntervals[logMsg.Type]; interval > 0 {
+			if last, ok := mm.LastWritten(meter); ok && logMsg.Time.Sub(last) < interval && !cfg.DisableDedup {
+				continue
+			}
+		}
+
+		// Skip cumulative messages whose consumption hasn't changed.
+		var reading, resetFrom Reading
+		var delta int64
+		var hasDelta bool
+		if c, ok := msg.(Cumulative); ok {
+			reading = Reading{Time: logMsg.Time, Consumption: c.CumulativeConsumption()}
+			last, ok := mm.LastReading(meter)
+			if cfg.DropLate && ok && reading.Time.Before(last.Time) {
+				log.Debugf("dropped late message from %d (%s)", meter.EndpointID, meter.Protocol)
+				continue
+			}
+			// A meter with real readings doesn't go back to zero, such
+			// messages are misdecoded.
+			if cfg.DropZero && ok && reading.Consumption == 0 && last.Consumption > 0 {
+				log.Debugf("dropped zero consumption message from %d (%s)", meter.EndpointID, meter.Protocol)
+				continue
+			}
+			if cfg.DedupCumulative && !cfg.DisableDedup && ok && last.Consumption == reading.Consumption {
+				continue
+			}
+			if !cfg.DisableDedup && buckets.Duplicate(meter, reading.Consumption, reading.Time) {
+				log.Debugf("dropped message from %d (%s), consumption already written in this bucket", meter.EndpointID, meter.Protocol)
 				continue
 			}
+			if cfg.DetectReset && ok && isReset(last, reading) {
+				resetFrom = last
+			}
+			if cfg.RateSmoothing > 0 && ok {
+				smoothRate(&reading, last, cfg.RateSmoothing)
+			}
+
+			// Write the highest consumption seen so the counter never
+			// decreases, unless the meter was reset.
+			if cfg.Monotonic {
+				reading.Max = reading.Consumption
+				if ok && last.Max > reading.Max && resetFrom.Consumption == 0 {
+					reading.Max = last.Max
+				}
+				c.SetCumulativeConsumption(reading.Max)
+			}
+
+			// The delta is the change from the consumption last written, left
+			// out when it decreased.
+			if cfg.EmitDelta && ok {
+				prev := last.Consumption
+				if cfg.Monotonic {
+					prev = last.Max
+				}
+				if cur := c.CumulativeConsumption(); cur >= prev {
+					delta, hasDelta = int64(cur-prev), true
+				}
+			}
+			if err := mm.SetReading(meter, reading); err != nil {
+				log.Warnf("%+v", xerrors.Errorf("mm.SetReading: %w", err))
+			}
+		}
+
+		// Points from known endpoint types may be written to a measurement
+		// for their commodity, e.g. utilities_water.
+		measurement := cfg.Measurements[logMsg.Type]
+		if cfg.MeasurementByType {
+			if name, ok := endpointTypeName(meter.Protocol, meter.EndpointType); ok {
+				measurement += "_" + name
+			}
 		}
 
+		unit, hasUnit := cfg.Units.Unit(meter)
+
 		pts := []*write.Point{}
 
 		// Messages know how to add points to a batch.
-		msg.AddPoints(logMsg, func(t time.Time, tags map[string]string, fields map[string]interface{}) {
-			pt := write.NewPoint(measurement, tags, fields, t)
+		eachFn := func(t time.Time, tags map[string]string, fields map[string]interface{}) {
+			if line.Source != "" {
+				tags["source"] = line.Source
+			}
+			if hasUnit {
+				tags["unit"] = unit
+			}
+			if reading.HasRate && tags["msg_type"] == msgTypeName("cumulative") {
+				fields["rate_ema"] = reading.Rate
+			}
+			if hasDelta && tags["msg_type"] == msgTypeName("cumulative") {
+				fields["delta"] = delta
+			}
+			if cfg.IncludeRaw && tags["msg_type"] == msgTypeName("cumulative") {
+				fields["raw"] = string(line.Data)
+			}
+			pt := newPoint(measurement, tags, fields, t)
 			pts = append(pts, pt)
-		})
+		}
+		msg.AddPoints(logMsg, eachFn)
 
-		if !dryRun {
-			err = api.WritePoint(context.Background(), pts...)
-			if err != nil {
-				log.Fatalf("%+v\n", xerrors.Errorf("api.WritePoint: %w", err))
+		if webhook != nil {
+			webhook.Notify(meter, alertStates(msg), logMsg.Time)
+		}
+
+		if resetFrom.Consumption > 0 {
+			eachFn(logMsg.Time, newTags(logMsg, "event", meter.EndpointType, meter.EndpointID), map[string]interface{}{
+				"reset":                int64(1),
+				"previous_consumption": int64(resetFrom.Consumption),
+			})
+		}
+
+		if cfg.Heartbeat {
+			fields := map[string]interface{}{
+				"last_seen": logMsg.Time.Unix(),
 			}
+			if seen {
+				fields["seconds_since_last_seen"] = int64(logMsg.Time.Sub(prev) / time.Second)
+			}
+			eachFn(logMsg.Time, newTags(logMsg, "heartbeat", meter.EndpointType, meter.EndpointID), fields)
+		}
+
+		if err := writePoints(pts); err != nil {
+			return err
+		}
+		mm.SetWritten(meter, logMsg.Time)
+	}
+}
+
+// decodeMessage decodes the message encapsulated by logMsg. A nil message
+// without error is one which should be ignored.
+func decodeMessage(logMsg LogMessage, mm MeterMap, cfg Config) (Message, error) {
+	// Store the appropriate message type in msg based on logMsg.Type.
+	var msg Message
+	switch logMsg.Type {
+	case "SCM":
+		msg = new(SCM)
+	case "SCM+":
+		msg = new(SCMPlus)
+	case "IDM", "NetIDM":
+		msg = new(IDM)
+	case "R900", "R900BCD":
+		msg = new(R900)
+	}
+
+	if cfg.StrictFields {
+		missing, err := missingFields(logMsg.Type, logMsg.Message)
+		if err != nil {
+			return nil, errors.Wrap(err, "json unmarshal")
+		}
+		if len(missing) > 0 {
+			return nil, xerrors.Errorf("%s message missing fields %s", logMsg.Type, strings.Join(missing, ", "))
+		}
+	}
+
+	// Parse the encapsulated message.
+	err := json.Unmarshal(logMsg.Message, msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshal")
+	}
+
+	// Disabled protocols are still decoded so malformed input is reported.
+	if !cfg.Enabled[logMsg.Type] {
+		return nil, nil
+	}
+
+	// If current message is an IDM.
+	if idm, ok := msg.(*IDM); ok {
+		// Store meter state for discarding duplicate data.
+		idm.Meters = mm
+		idm.DisableDedup = cfg.DisableDedup
+		idm.IntervalDuration = cfg.IDMInterval
+		idm.Rate = cfg.IDMRate
+		idm.Extended = cfg.IDMExtended
+		idm.TrackFirmware = cfg.TrackFirmware
+		idm.ChangedOnly = cfg.IDMChangedOnly
+
+		// If COLLECT_INFLUXDB_STRICTIDM is defined, disallow IDM of type 8.
+		if cfg.StrictIDM && logMsg.Type == "IDM" && idm.EndpointType == 8 {
+			return nil, nil
+		}
+
+		// If COLLECT_INFLUXDB_STRICTIDM is defined, disallow NetIDM of type 7.
+		if cfg.StrictIDM && logMsg.Type == "NetIDM" && idm.EndpointType == 7 {
+			return nil, nil
 		}
 	}
+
+	if r900, ok := msg.(*R900); ok {
+		r900.Raw = cfg.R900Raw
+		r900.GallonsPerUnit = cfg.R900GallonsPerUnit
+		r900.Alerts = cfg.R900Alerts
+	}
+
+	return msg, nil
 }
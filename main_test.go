@@ -0,0 +1,664 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// testPoint is a point captured from AddPoints.
+type testPoint struct {
+	Measurement string
+	Time        time.Time
+	Tags        map[string]string
+	Fields      map[string]interface{}
+}
+
+// testConfig is the configuration used by tests unless they change it, with
+// every protocol enabled and written to the measurement rtlamr.
+func testConfig() Config {
+	cfg := Config{
+		Enabled:            map[string]bool{},
+		Measurements:       map[string]string{},
+		IDMInterval:        5 * time.Minute,
+		R900GallonsPerUnit: 1,
+	}
+	for protocol := range protocolSuffix {
+		cfg.Enabled[protocol] = true
+		cfg.Measurements[protocol] = "rtlamr"
+	}
+	return cfg
+}
+
+// decodePoints decodes line and returns the points its message adds, in
+// order.
+func decodePoints(t *testing.T, line string, mm MeterMap, cfg Config) []testPoint {
+	t.Helper()
+
+	var logMsg LogMessage
+	if err := json.Unmarshal([]byte(line), &logMsg); err != nil {
+		t.Fatalf("json.Unmarshal: %+v", err)
+	}
+
+	msg, err := decodeMessage(logMsg, mm, cfg)
+	if err != nil {
+		t.Fatalf("decodeMessage: %+v", err)
+	}
+	if msg == nil {
+		t.Fatal("message was ignored")
+	}
+
+	var pts []testPoint
+	msg.AddPoints(logMsg, func(ts time.Time, tags map[string]string, fields map[string]interface{}) {
+		pt := newPoint(cfg.Measurements[logMsg.Type], tags, fields, ts)
+
+		got := testPoint{pt.Name(), pt.Time(), map[string]string{}, map[string]interface{}{}}
+		for _, tag := range pt.TagList() {
+			got.Tags[tag.Key] = tag.Value
+		}
+		for _, field := range pt.FieldList() {
+			got.Fields[field.Key] = field.Value
+		}
+		pts = append(pts, got)
+	})
+	return pts
+}
+
+func newTestMeterMap(t *testing.T) MeterMap {
+	t.Helper()
+
+	mm, err := NewMeterMap("", false)
+	if err != nil {
+		t.Fatalf("NewMeterMap: %+v", err)
+	}
+	return mm
+}
+
+func checkPoints(t *testing.T, got, want []testPoint) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d points, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) {
+			t.Errorf("point %d: time %s, want %s", i, got[i].Time, want[i].Time)
+		}
+		got[i].Time = want[i].Time
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("point %d:\n got %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+var testTime = time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+func TestAddPoints(t *testing.T) {
+	cases := []struct {
+		Name string
+		Line string
+		Want []testPoint
+	}{
+		{
+			Name: "SCM",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"SCM","Message":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime,
+					Tags:        map[string]string{"protocol": "SCM", "msg_type": "cumulative", "endpoint_type": "4", "endpoint_id": "1"},
+					Fields:      map[string]interface{}{"consumption": int64(5)},
+				},
+			},
+		},
+		{
+			Name: "SCM+",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"SCM+","Message":{"FrameSync":5795,"ProtocolID":30,"EndpointType":156,"EndpointID":2,"Consumption":7,"Tamper":0,"PacketCRC":0}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime,
+					Tags:        map[string]string{"protocol": "SCM+", "msg_type": "cumulative", "endpoint_type": "156", "endpoint_id": "2"},
+					Fields:      map[string]interface{}{"consumption": int64(7)},
+				},
+			},
+		},
+		{
+			// TransmitTimeOffset is in 1/16ths of a second, so every point is
+			// a second earlier than the message.
+			Name: "IDM",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":2,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":[1,2],"TransmitTimeOffset":16}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime.Add(-time.Second),
+					Tags:        map[string]string{"protocol": "IDM", "msg_type": "cumulative", "endpoint_type": "7", "endpoint_id": "3"},
+					Fields:      map[string]interface{}{"consumption": int64(100)},
+				},
+				{
+					Measurement: "rtlamr",
+					Time:        testTime.Add(-time.Second),
+					Tags:        map[string]string{"protocol": "IDM", "msg_type": "differential", "endpoint_type": "7", "endpoint_id": "3"},
+					Fields:      map[string]interface{}{"consumption": int64(1), "interval": int64(2)},
+				},
+				{
+					Measurement: "rtlamr",
+					Time:        testTime.Add(-5*time.Minute - time.Second),
+					Tags:        map[string]string{"protocol": "IDM", "msg_type": "differential", "endpoint_type": "7", "endpoint_id": "3"},
+					Fields:      map[string]interface{}{"consumption": int64(2), "interval": int64(1)},
+				},
+			},
+		},
+		{
+			Name: "NetIDM",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"NetIDM","Message":{"ERTType":8,"ERTSerialNumber":4,"ConsumptionIntervalCount":2,"LastConsumption":500,"LastConsumptionNet":400,"LastGeneration":100,"DifferentialConsumptionIntervals":[1],"TransmitTimeOffset":16}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime.Add(-time.Second),
+					Tags:        map[string]string{"protocol": "NetIDM", "msg_type": "cumulative", "endpoint_type": "8", "endpoint_id": "4"},
+					Fields:      map[string]interface{}{"consumption": int64(500), "consumption_net": int64(400), "generation": int64(100)},
+				},
+				{
+					Measurement: "rtlamr",
+					Time:        testTime.Add(-time.Second),
+					Tags:        map[string]string{"protocol": "NetIDM", "msg_type": "differential", "endpoint_type": "8", "endpoint_id": "4"},
+					Fields:      map[string]interface{}{"consumption": int64(1), "interval": int64(2)},
+				},
+			},
+		},
+		{
+			Name: "R900",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"R900","Message":{"ID":5,"Unkn1":163,"NoUse":1,"BackFlow":2,"Consumption":1234,"Unkn3":0,"Leak":3,"LeakNow":1}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime,
+					Tags:        map[string]string{"protocol": "R900", "msg_type": "cumulative", "endpoint_type": "163", "endpoint_id": "5"},
+					Fields: map[string]interface{}{
+						"consumption": int64(1234),
+						"nouse":       int64(1),
+						"backflow":    int64(2),
+						"leak":        int64(3),
+						"leak_now":    int64(1),
+						"gallons":     float64(1234),
+					},
+				},
+			},
+		},
+		{
+			Name: "R900BCD",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Type":"R900BCD","Message":{"ID":6,"Unkn1":163,"NoUse":0,"BackFlow":0,"Consumption":4321,"Unkn3":0,"Leak":0,"LeakNow":0}}`,
+			Want: []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime,
+					Tags:        map[string]string{"protocol": "R900BCD", "msg_type": "cumulative", "endpoint_type": "163", "endpoint_id": "6"},
+					Fields: map[string]interface{}{
+						"consumption": int64(4321),
+						"nouse":       int64(0),
+						"backflow":    int64(0),
+						"leak":        int64(0),
+						"leak_now":    int64(0),
+						"gallons":     float64(4321),
+					},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			mm := newTestMeterMap(t)
+			defer mm.Close()
+
+			checkPoints(t, decodePoints(t, c.Line, mm, testConfig()), c.Want)
+		})
+	}
+}
+
+// TestIDMDedup checks that a repeated IDM message only writes its
+// differential intervals again if its interval's time moved by more than
+// threshold.
+func TestIDMDedup(t *testing.T) {
+	const first = `{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":2,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":[1,2],"TransmitTimeOffset":0}}`
+
+	cases := []struct {
+		Name   string
+		Time   string
+		Points int
+	}{
+		{"same time", "2020-01-01T10:00:00Z", 1},
+		{"within threshold", "2020-01-01T10:00:20Z", 1},
+		{"outside threshold", "2020-01-01T10:00:45Z", 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			mm := newTestMeterMap(t)
+			defer mm.Close()
+			cfg := testConfig()
+
+			if got := decodePoints(t, first, mm, cfg); len(got) != 3 {
+				t.Fatalf("first message wrote %d points, want 3", len(got))
+			}
+
+			var repeat map[string]interface{}
+			json.Unmarshal([]byte(first), &repeat)
+			repeat["Time"] = c.Time
+			line, _ := json.Marshal(repeat)
+
+			got := decodePoints(t, string(line), mm, cfg)
+			if len(got) != c.Points {
+				t.Fatalf("repeated message wrote %d points, want %d: %+v", len(got), c.Points, got)
+			}
+			if got[0].Tags["msg_type"] != "cumulative" {
+				t.Errorf("first point msg_type %q, want cumulative", got[0].Tags["msg_type"])
+			}
+		})
+	}
+}
+
+// memSink keeps the points written to it.
+type memSink struct {
+	mu  sync.Mutex
+	pts []*write.Point
+}
+
+func (s *memSink) WritePoints(pts []*write.Point) error {
+	s.mu.Lock()
+	s.pts = append(s.pts, pts...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+// count returns the number of points written with the given msg_type.
+func (s *memSink) count(msgType string) (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pt := range s.pts {
+		for _, tag := range pt.TagList() {
+			if tag.Key == "msg_type" && tag.Value == msgType {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// processLines runs process over lines with an in-memory state and returns
+// what it wrote.
+func processLines(t *testing.T, cfg Config, lines []string) *memSink {
+	t.Helper()
+
+	mm := newTestMeterMap(t)
+	defer mm.Close()
+
+	cfg.MaxLineBytes = 1 << 20
+	cfg.Workers = 1
+
+	sink := &memSink{}
+	input := strings.NewReader(strings.Join(lines, "\n") + "\n")
+	if err := process([]Input{{ReadCloser: ioutil.NopCloser(input)}}, sink, mm, cfg); err != nil {
+		t.Fatalf("process: %+v", err)
+	}
+	return sink
+}
+
+// TestProcessConcurrentFlush drives process while state is flushed and read
+// concurrently, like the shutdown timeout does. Run with -race.
+func TestProcessConcurrentFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtlamr-collect")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mm, err := NewMeterMap(filepath.Join(dir, "meters.db"), true)
+	if err != nil {
+		t.Fatalf("NewMeterMap: %+v", err)
+	}
+	defer mm.Close()
+
+	const messages = 2000
+	var input strings.Builder
+	for i := 0; i < messages; i++ {
+		fmt.Fprintf(&input, `{"Time":"2020-01-01T10:%02d:%02dZ","Type":"SCM","Message":{"ID":%d,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":%d,"ChecksumVal":0}}`+"\n", i/60%60, i%60, i%100, i)
+	}
+
+	cfg := testConfig()
+	cfg.MaxLineBytes = 1 << 20
+	cfg.Workers = 1
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := mm.Flush(); err != nil {
+				t.Errorf("mm.Flush: %+v", err)
+			}
+			mm.LastReading(Meter{EndpointID: 1, EndpointType: 4, Protocol: "SCM"})
+		}
+	}()
+
+	sink := &memSink{}
+	inputs := []Input{{ReadCloser: ioutil.NopCloser(strings.NewReader(input.String()))}}
+	err = process(inputs, sink, mm, cfg)
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("process: %+v", err)
+	}
+	if len(sink.pts) != messages {
+		t.Errorf("wrote %d points, want %d", len(sink.pts), messages)
+	}
+	if reading, ok := mm.LastReading(Meter{EndpointID: 99, EndpointType: 4, Protocol: "SCM"}); !ok || reading.Consumption != messages-1 {
+		t.Errorf("last reading of meter 99 is %+v, want consumption %d", reading, messages-1)
+	}
+}
+
+// TestBucketFilter checks that COLLECT_DEDUP_BUCKET drops repeated
+// consumption from cumulative protocols only. IDM and NetIDM messages are
+// never dropped, since they also carry differential intervals.
+func TestBucketFilter(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Format string
+		Want   int
+	}{
+		{"SCM", `{"Time":"2020-01-01T10:%02d:00Z","Type":"SCM","Message":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`, 1},
+		{"SCM+", `{"Time":"2020-01-01T10:%02d:00Z","Type":"SCM+","Message":{"FrameSync":5795,"ProtocolID":30,"EndpointType":156,"EndpointID":2,"Consumption":7,"Tamper":0,"PacketCRC":0}}`, 1},
+		{"R900", `{"Time":"2020-01-01T10:%02d:00Z","Type":"R900","Message":{"ID":5,"Unkn1":163,"NoUse":0,"BackFlow":0,"Consumption":1234,"Unkn3":0,"Leak":0,"LeakNow":0}}`, 1},
+		{"IDM", `{"Time":"2020-01-01T10:%02d:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":2,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":[0],"TransmitTimeOffset":0}}`, 3},
+		{"NetIDM", `{"Time":"2020-01-01T10:%02d:00Z","Type":"NetIDM","Message":{"ERTType":8,"ERTSerialNumber":4,"ConsumptionIntervalCount":2,"LastConsumption":500,"LastConsumptionNet":400,"LastGeneration":100,"DifferentialConsumptionIntervals":[0],"TransmitTimeOffset":0}}`, 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DedupBucket = time.Hour
+
+			var lines []string
+			for _, minute := range []int{0, 1, 2} {
+				lines = append(lines, fmt.Sprintf(c.Format, minute))
+			}
+
+			if got := processLines(t, cfg, lines).count("cumulative"); got != c.Want {
+				t.Errorf("wrote %d cumulative points, want %d", got, c.Want)
+			}
+		})
+	}
+}
+
+func TestOutageBit(t *testing.T) {
+	const all = 1<<48 - 1
+
+	cases := []struct {
+		Name   string
+		Outage uint64
+		Idx    int
+		Want   bool
+	}{
+		{"most recent interval", 1 << 46, 0, true},
+		{"oldest interval", 1 << 0, outageIntervals - 1, true},
+		{"neighbouring interval", 1 << 46, 1, false},
+		{"unused top bit", 1 << 47, 0, false},
+		{"all set, first", all, 0, true},
+		{"all set, last", all, outageIntervals - 1, true},
+		{"all set, past the flags", all, outageIntervals, false},
+		{"all set, far past the flags", all, 255, false},
+		{"all set, negative", all, -1, false},
+		{"none set", 0, 10, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := outageBit(c.Outage, c.Idx); got != c.Want {
+				t.Errorf("outageBit(%#x, %d) = %v, want %v", c.Outage, c.Idx, got, c.Want)
+			}
+		})
+	}
+}
+
+// TestIDMLongOutage decodes a message reporting an outage through every
+// interval the flags cover, with more intervals than there are flags.
+func TestIDMLongOutage(t *testing.T) {
+	intervals := make([]int, outageIntervals+5)
+	for i := range intervals {
+		intervals[i] = i
+	}
+	diffs, _ := json.Marshal(intervals)
+	flags := base64.StdEncoding.EncodeToString([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	line := fmt.Sprintf(`{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":100,"PowerOutageFlags":%q,"LastConsumptionCount":100,"DifferentialConsumptionIntervals":%s,"TransmitTimeOffset":0}}`, flags, diffs)
+
+	mm := newTestMeterMap(t)
+	defer mm.Close()
+
+	pts := decodePoints(t, line, mm, testConfig())
+	if len(pts) != len(intervals)+1 {
+		t.Fatalf("got %d points, want %d", len(pts), len(intervals)+1)
+	}
+
+	for idx, pt := range pts[1:] {
+		_, outage := pt.Fields["outage"]
+		if want := idx < outageIntervals; outage != want {
+			t.Errorf("interval %d: outage %v, want %v", idx, outage, want)
+		}
+		if want := testTime.Add(-time.Duration(idx) * 5 * time.Minute); !pt.Time.Equal(want) {
+			t.Errorf("interval %d: time %s, want %s", idx, pt.Time, want)
+		}
+	}
+
+	if last, ok := mm.Last(Meter{EndpointID: 3, EndpointType: 7, Protocol: "IDM"}); !ok || !last.Outage {
+		t.Errorf("meter state %+v, want outage", last)
+	}
+}
+
+// toBCD encodes n as binary-coded decimal, the way R900BCD meters transmit
+// consumption.
+func toBCD(n uint32) (bcd uint32) {
+	for shift := uint(0); n > 0; shift += 4 {
+		bcd |= (n % 10) << shift
+		n /= 10
+	}
+	return bcd
+}
+
+// TestR900BCD checks that R900 and R900BCD messages for the same reading are
+// written the same way. R900 meters transmit consumption in binary, R900BCD
+// meters in BCD, and rtlamr reports both as the decoded decimal value, so
+// consumption must be written as received rather than decoded again.
+func TestR900BCD(t *testing.T) {
+	const format = `{"Time":"2020-01-01T10:00:00Z","Type":"%s","Message":{"ID":6,"Unkn1":163,"NoUse":0,"BackFlow":0,"Consumption":%d,"Unkn3":0,"Leak":0,"LeakNow":0}}`
+
+	cases := []struct {
+		Reading uint32
+		// Binary and BCD are the consumption bits transmitted by each.
+		Binary uint32
+		BCD    uint32
+	}{
+		{0, 0x0, 0x0},
+		{9, 0x9, 0x9},
+		{10, 0xa, 0x10},
+		{1234, 0x4d2, 0x1234},
+		{999999, 0xf423f, 0x999999},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.Reading), func(t *testing.T) {
+			if c.Binary != c.Reading || toBCD(c.Reading) != c.BCD {
+				t.Fatalf("bad sample: binary %#x, bcd %#x for %d", c.Binary, c.BCD, c.Reading)
+			}
+
+			var pts [2][]testPoint
+			for i, protocol := range []string{"R900", "R900BCD"} {
+				mm := newTestMeterMap(t)
+				pts[i] = decodePoints(t, fmt.Sprintf(format, protocol, c.Reading), mm, testConfig())
+				mm.Close()
+
+				if len(pts[i]) != 1 {
+					t.Fatalf("%s: got %d points, want 1", protocol, len(pts[i]))
+				}
+				if got := pts[i][0].Fields["consumption"]; got != int64(c.Reading) {
+					t.Errorf("%s: consumption %v, want %d", protocol, got, c.Reading)
+				}
+				if got := pts[i][0].Fields["gallons"]; got != float64(c.Reading) {
+					t.Errorf("%s: gallons %v, want %d", protocol, got, c.Reading)
+				}
+			}
+
+			if !reflect.DeepEqual(pts[0][0].Fields, pts[1][0].Fields) {
+				t.Errorf("fields differ:\n R900    %v\n R900BCD %v", pts[0][0].Fields, pts[1][0].Fields)
+			}
+			if pts[1][0].Tags["protocol"] != "R900BCD" {
+				t.Errorf("R900BCD protocol tag %q", pts[1][0].Tags["protocol"])
+			}
+		})
+	}
+}
+
+// TestIDMIntervalWrap checks interval numbers and times when the interval
+// count is near either end of its byte range.
+func TestIDMIntervalWrap(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Idx   byte
+		Count int
+		Want  []int64
+	}{
+		{"at 0", 0, 3, []int64{0, 255, 254}},
+		{"near 0", 2, 5, []int64{2, 1, 0, 255, 254}},
+		{"at 255", 255, 3, []int64{255, 254, 253}},
+		{"just after 255", 1, 4, []int64{1, 0, 255, 254}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			diffs, _ := json.Marshal(make([]int, c.Count))
+			line := fmt.Sprintf(`{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":%d,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":%s,"TransmitTimeOffset":32}}`, c.Idx, diffs)
+
+			mm := newTestMeterMap(t)
+			defer mm.Close()
+
+			pts := decodePoints(t, line, mm, testConfig())
+			if len(pts) != c.Count+1 {
+				t.Fatalf("got %d points, want %d", len(pts), c.Count+1)
+			}
+
+			for idx, pt := range pts[1:] {
+				if got := pt.Fields["interval"]; got != c.Want[idx] {
+					t.Errorf("interval %d: number %v, want %d", idx, got, c.Want[idx])
+				}
+				wantTime := testTime.Add(-time.Duration(idx)*5*time.Minute - 2*time.Second)
+				if !pt.Time.Equal(wantTime) {
+					t.Errorf("interval %d: time %s, want %s", idx, pt.Time, wantTime)
+				}
+			}
+
+			// A repeat of the message is recognised across the wrap.
+			if got := decodePoints(t, line, mm, testConfig()); len(got) != 1 {
+				t.Errorf("repeated message wrote %d points, want 1", len(got))
+			}
+		})
+	}
+}
+
+// TestJSONKeys decodes messages from rtlamr builds using other key names,
+// configured through COLLECT_JSON_KEYS.
+func TestJSONKeys(t *testing.T) {
+	cases := []struct {
+		Name string
+		Keys string
+		Line string
+		Err  bool
+	}{
+		{
+			Name: "all renamed",
+			Keys: "Time=ts,Type=kind,Message=msg",
+			Line: `{"ts":"2020-01-01T10:00:00Z","kind":"SCM","msg":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`,
+		},
+		{
+			Name: "some renamed",
+			Keys: "Time=timestamp",
+			Line: `{"timestamp":"2020-01-01T10:00:00Z","Type":"SCM","Message":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`,
+		},
+		{
+			Name: "renamed to another default name",
+			Keys: "Type=Message,Message=payload",
+			Line: `{"Time":"2020-01-01T10:00:00Z","Message":"SCM","payload":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`,
+		},
+		{Name: "unknown field", Keys: "Timestamp=ts", Err: true},
+		{Name: "empty key", Keys: "Time=", Err: true},
+	}
+
+	defer os.Unsetenv("COLLECT_JSON_KEYS")
+	defer os.Unsetenv("COLLECT_INFLUXDB_DRYRUN")
+	defer func() { jsonKeys = nil }()
+
+	os.Setenv("COLLECT_INFLUXDB_DRYRUN", "1")
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			os.Setenv("COLLECT_JSON_KEYS", c.Keys)
+			cfg, err := NewConfigFromEnv()
+			if c.Err {
+				if err == nil {
+					t.Fatal("invalid keys were accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewConfigFromEnv: %+v", err)
+			}
+			jsonKeys = cfg.JSONKeys
+
+			mm := newTestMeterMap(t)
+			defer mm.Close()
+
+			checkPoints(t, decodePoints(t, c.Line, mm, testConfig()), []testPoint{
+				{
+					Measurement: "rtlamr",
+					Time:        testTime,
+					Tags:        map[string]string{"protocol": "SCM", "msg_type": "cumulative", "endpoint_type": "4", "endpoint_id": "1"},
+					Fields:      map[string]interface{}{"consumption": int64(5)},
+				},
+			})
+		})
+	}
+}
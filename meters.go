@@ -0,0 +1,195 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+// seenMeter summarizes the messages heard from a meter.
+type seenMeter struct {
+	Meter
+	Messages int
+	LastSeen time.Time
+}
+
+// listMeters implements the meters subcommand. With a state database
+// filename, it lists the meters with state in it. Otherwise it lists the
+// meters heard from in rtlamr's output on stdin until EOF or an interrupt.
+func listMeters(args []string) {
+	var meters []seenMeter
+	var err error
+	if len(args) > 0 {
+		meters, err = stateMeters(args[0])
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("stateMeters: %w", err))
+		}
+	} else {
+		meters, err = captureMeters(os.Stdin)
+		if err != nil {
+			log.Fatalf("%+v\n", xerrors.Errorf("captureMeters: %w", err))
+		}
+	}
+
+	sort.Slice(meters, func(i, j int) bool {
+		if meters[i].Protocol != meters[j].Protocol {
+			return meters[i].Protocol < meters[j].Protocol
+		}
+		return meters[i].EndpointID < meters[j].EndpointID
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTOCOL\tENDPOINT_ID\tENDPOINT_TYPE\tCOMMODITY\tMESSAGES\tLAST_SEEN")
+	for _, m := range meters {
+		commodity, ok := endpointTypeName(m.Protocol, m.EndpointType)
+		if !ok {
+			commodity = "-"
+		}
+		messages := "-"
+		if m.Messages > 0 {
+			messages = strconv.Itoa(m.Messages)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n",
+			m.Protocol, m.EndpointID, m.EndpointType, commodity, messages,
+			m.LastSeen.Format(time.RFC3339),
+		)
+	}
+	w.Flush()
+}
+
+// stateMeters lists the meters with state in the database filename. IDM and
+// NetIDM meters keep state, and their last seen time is that of their last
+// interval, as do cumulative meters, with the time of their last reading. The
+// database is opened read-only, so it may be listed while the collector is
+// running.
+func stateMeters(filename string) ([]seenMeter, error) {
+	mm, err := NewMeterMap("", false)
+	if err != nil {
+		return nil, xerrors.Errorf("NewMeterMap: %w", err)
+	}
+
+	// Opening a missing file read-only fails with an unhelpful error.
+	if _, err := os.Stat(filename); err != nil {
+		return nil, xerrors.Errorf("os.Stat: %w", err)
+	}
+
+	mm.db, err = bbolt.Open(filename, 0600, &bbolt.Options{
+		ReadOnly: true,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("bbolt.Open: %w", err)
+	}
+	defer mm.Close()
+
+	if err := mm.load(); err != nil {
+		return nil, err
+	}
+
+	var meters []seenMeter
+	mm.EachLast(func(meter Meter, msg LastMessage) {
+		meters = append(meters, seenMeter{Meter: meter, LastSeen: msg.Time})
+	})
+	return meters, nil
+}
+
+// captureMeters lists the meters heard from in r until EOF or an interrupt.
+// Lines which aren't rtlamr json or csv are ignored.
+func captureMeters(r io.Reader) ([]seenMeter, error) {
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	mm, err := NewMeterMap("", false)
+	if err != nil {
+		return nil, xerrors.Errorf("NewMeterMap: %w", err)
+	}
+
+	cfg := Config{Enabled: map[string]bool{}}
+	for protocol := range protocolSuffix {
+		cfg.Enabled[protocol] = true
+	}
+
+	lines := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+		errs <- scanner.Err()
+	}()
+
+	seen := map[Meter]*seenMeter{}
+	for {
+		var line []byte
+		select {
+		case line = <-lines:
+		case err := <-errs:
+			if err != nil {
+				return nil, xerrors.Errorf("scanner.Scan: %w", err)
+			}
+			return seenMeterList(seen), nil
+		case <-interrupt:
+			return seenMeterList(seen), nil
+		}
+
+		for _, line := range splitArray(line) {
+			var logMsg LogMessage
+			if len(line) > 0 && line[0] == '{' {
+				err = json.Unmarshal(line, &logMsg)
+			} else {
+				logMsg, err = parseCSV(line)
+			}
+			if err != nil {
+				continue
+			}
+
+			msg, err := decodeMessage(logMsg, mm, cfg)
+			if err != nil || msg == nil {
+				continue
+			}
+
+			meter := msg.Meter(logMsg.Type)
+			if seen[meter] == nil {
+				seen[meter] = &seenMeter{Meter: meter}
+			}
+			seen[meter].Messages++
+			seen[meter].LastSeen = logMsg.Time
+		}
+	}
+}
+
+func seenMeterList(seen map[Meter]*seenMeter) []seenMeter {
+	meters := make([]seenMeter, 0, len(seen))
+	for _, m := range seen {
+		meters = append(meters, *m)
+	}
+	return meters
+}
@@ -0,0 +1,404 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// mqttTimeout bounds connecting to the broker.
+const mqttTimeout = 5 * time.Second
+
+// mqttKeepalive is how often the broker expects to hear from the client.
+const mqttKeepalive = 60 * time.Second
+
+// mqttTopicPrefix is the first level of every topic points are published to.
+const mqttTopicPrefix = "rtlamr"
+
+// mqttConn is a minimal MQTT 3.1.1 client, supporting only what MQTTSink
+// needs: publishing at QoS 0.
+type mqttConn struct {
+	conn net.Conn
+	w    *bufio.Writer
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	lastErr error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// mqttConnackErrors describes the return codes of a refused connection.
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func dialMQTT(rawurl string) (*mqttConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, xerrors.Errorf("url.Parse: %w", err)
+	}
+	if u.Scheme != "mqtt" {
+		return nil, xerrors.Errorf("unsupported scheme %q, expected mqtt", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1883")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, mqttTimeout)
+	if err != nil {
+		return nil, xerrors.Errorf("net.DialTimeout: %w", err)
+	}
+
+	mc := &mqttConn{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		done: make(chan struct{}),
+	}
+
+	// Variable header: protocol name and level, flags and keepalive.
+	flags := byte(0x02) // Clean session.
+	var payload []byte
+	payload = appendMQTTString(payload, fmt.Sprintf("rtlamr-collect-%d", os.Getpid()))
+	if u.User != nil {
+		flags |= 0x80
+		payload = appendMQTTString(payload, u.User.Username())
+		if pass, ok := u.User.Password(); ok {
+			flags |= 0x40
+			payload = appendMQTTString(payload, pass)
+		}
+	}
+
+	connect := appendMQTTString(nil, "MQTT")
+	connect = append(connect, 4, flags, byte(mqttKeepalive/time.Second>>8), byte(mqttKeepalive/time.Second))
+	connect = append(connect, payload...)
+
+	mc.wmu.Lock()
+	err = mc.writePacket(0x10, connect)
+	mc.wmu.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, xerrors.Errorf("writePacket: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(r, connack); err != nil {
+		conn.Close()
+		return nil, xerrors.Errorf("expected CONNACK from broker: %w", err)
+	}
+	if connack[0] != 0x20 || connack[1] != 2 {
+		conn.Close()
+		return nil, xerrors.Errorf("expected CONNACK from broker: % x", connack)
+	}
+	if rc := connack[3]; rc != 0 {
+		conn.Close()
+		if msg, ok := mqttConnackErrors[rc]; ok {
+			return nil, xerrors.Errorf("connection refused: %s", msg)
+		}
+		return nil, xerrors.Errorf("connection refused: return code %d", rc)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go mc.read(r)
+	go mc.ping()
+
+	return mc, nil
+}
+
+// appendMQTTString appends s prefixed by its length.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// writePacket writes a packet with the given type and flags, the first byte of
+// the fixed header. The caller must hold wmu.
+func (mc *mqttConn) writePacket(header byte, body []byte) error {
+	mc.w.WriteByte(header)
+
+	// The remaining length is encoded 7 bits at a time, least significant
+	// first.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		mc.w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+
+	mc.w.Write(body)
+	return mc.w.Flush()
+}
+
+// read discards packets from the broker, which only sends PINGRESP to a
+// client which doesn't subscribe, until the connection is closed.
+func (mc *mqttConn) read(r *bufio.Reader) {
+	_, err := io.Copy(ioutil.Discard, r)
+	if err == nil {
+		err = io.EOF
+	}
+	mc.setErr(xerrors.Errorf("connection lost: %w", err))
+}
+
+// ping keeps the connection alive while nothing is published.
+func (mc *mqttConn) ping() {
+	ticker := time.NewTicker(mqttKeepalive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mc.wmu.Lock()
+			err := mc.writePacket(0xc0, nil)
+			mc.wmu.Unlock()
+			if err != nil {
+				mc.setErr(xerrors.Errorf("writePacket: %w", err))
+				return
+			}
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+func (mc *mqttConn) setErr(err error) {
+	mc.mu.Lock()
+	if mc.lastErr == nil {
+		mc.lastErr = err
+	}
+	mc.mu.Unlock()
+}
+
+func (mc *mqttConn) err() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.lastErr
+}
+
+// Publish sends data to topic at QoS 0. Retained messages are kept by the
+// broker and sent to future subscribers. A failed write is recorded like a
+// lost connection.
+func (mc *mqttConn) Publish(topic string, data []byte, retain bool) error {
+	if err := mc.err(); err != nil {
+		return err
+	}
+
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+	}
+
+	mc.wmu.Lock()
+	err := mc.writePacket(header, append(appendMQTTString(nil, topic), data...))
+	mc.wmu.Unlock()
+	if err != nil {
+		err = xerrors.Errorf("writePacket: %w", err)
+		mc.setErr(err)
+	}
+	return err
+}
+
+// Close disconnects from the broker. It may be called more than once, e.g.
+// when redialing fails.
+func (mc *mqttConn) Close() error {
+	mc.closeOnce.Do(func() { close(mc.done) })
+
+	mc.wmu.Lock()
+	mc.writePacket(0xe0, nil)
+	mc.wmu.Unlock()
+	return mc.conn.Close()
+}
+
+// mqttTopicLevel converts a protocol name to a topic level. A + is a wildcard
+// in topic filters, so SCM+ becomes scmplus.
+func mqttTopicLevel(protocol string) string {
+	return strings.ToLower(strings.Replace(protocol, "+", "plus", -1))
+}
+
+// MQTTSink publishes each point as json or msgpack to
+// rtlamr/<protocol>/<endpoint_id>/<msg_type>. If a discovery prefix is given,
+// each meter is announced to Home Assistant the first time it is heard, and
+// again after reconnecting to the broker.
+type MQTTSink struct {
+	url       string
+	mc        *mqttConn
+	discovery string
+	format    string
+
+	announced map[string]bool
+}
+
+func NewMQTTSink(rawurl, discovery, format string) (*MQTTSink, error) {
+	mc, err := dialMQTT(rawurl)
+	if err != nil {
+		return nil, xerrors.Errorf("dialMQTT: %w", err)
+	}
+
+	return &MQTTSink{
+		url:       rawurl,
+		mc:        mc,
+		discovery: discovery,
+		format:    format,
+		announced: map[string]bool{},
+	}, nil
+}
+
+func (s *MQTTSink) WritePoints(pts []*write.Point) error {
+	if err := s.mc.err(); err != nil {
+		log.Warnf("mqtt: %+v, reconnecting", err)
+
+		s.mc.Close()
+		mc, err := dialMQTT(s.url)
+		if err != nil {
+			return xerrors.Errorf("dialMQTT: %w", err)
+		}
+		s.mc = mc
+
+		// Discovery configs are retained, but the broker may have lost them
+		// if it restarted.
+		s.announced = map[string]bool{}
+	}
+
+	for _, pt := range pts {
+		payload := NewPointPayload(pt)
+		data, err := payload.Marshal(s.format)
+		if err != nil {
+			return xerrors.Errorf("payload.Marshal: %w", err)
+		}
+
+		topic := strings.Join([]string{
+			mqttTopicPrefix,
+			mqttTopicLevel(payload.Tags["protocol"]),
+			payload.Tags["endpoint_id"],
+			payload.Tags["msg_type"],
+		}, "/")
+
+		if s.discovery != "" && payload.Tags["msg_type"] == msgTypeName("cumulative") {
+			if err := s.announce(topic, payload); err != nil {
+				return xerrors.Errorf("announce: %w", err)
+			}
+		}
+
+		if err := s.mc.Publish(topic, data, false); err != nil {
+			return xerrors.Errorf("mc.Publish: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// haDeviceClasses maps commodities to Home Assistant device classes.
+var haDeviceClasses = map[string]string{
+	"electric": "energy",
+	"gas":      "gas",
+	"water":    "water",
+}
+
+// announce publishes a retained Home Assistant discovery config for the meter
+// whose cumulative points are published to stateTopic, once per meter.
+func (s *MQTTSink) announce(stateTopic string, payload PointPayload) error {
+	protocol := mqttTopicLevel(payload.Tags["protocol"])
+	id := payload.Tags["endpoint_id"]
+	uniqueID := "rtlamr_" + protocol + "_" + id
+	if s.announced[uniqueID] {
+		return nil
+	}
+
+	// Raw consumption is in units which depend on the meter, e.g. tenths of
+	// a gallon. R900's gallons field is scaled by COLLECT_R900_GALLONS_PER_UNIT
+	// and other meters' units are only known if COLLECT_UNITS gives them.
+	field, unit := "consumption", payload.Tags["unit"]
+	isR900 := payload.Tags["protocol"] == "R900" || payload.Tags["protocol"] == "R900BCD"
+	if isR900 {
+		field, unit = "gallons", "gal"
+	}
+	if name, ok := fieldMap[field]; ok {
+		field = name
+	}
+
+	name := "Meter " + id
+	config := map[string]interface{}{
+		"unique_id":      uniqueID,
+		"object_id":      uniqueID,
+		"state_topic":    stateTopic,
+		"value_template": "{{ value_json.fields." + field + " }}",
+		"state_class":    "total_increasing",
+		"device": map[string]interface{}{
+			"identifiers":  []string{uniqueID},
+			"model":        payload.Tags["protocol"],
+			"manufacturer": "rtlamr-collect",
+		},
+	}
+
+	endpointType, _ := strconv.Atoi(payload.Tags["endpoint_type"])
+	if commodity, ok := endpointTypeName(payload.Tags["protocol"], uint8(endpointType)); ok {
+		name = strings.ToUpper(commodity[:1]) + commodity[1:] + " meter " + id
+		if class, ok := haDeviceClasses[commodity]; ok && unit != "" {
+			config["device_class"] = class
+		}
+	}
+	if unit != "" {
+		config["unit_of_measurement"] = unit
+	}
+	config["name"] = name
+	config["device"].(map[string]interface{})["name"] = name
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	topic := s.discovery + "/sensor/" + uniqueID + "/config"
+	if err := s.mc.Publish(topic, data, true); err != nil {
+		return xerrors.Errorf("mc.Publish: %w", err)
+	}
+
+	s.announced[uniqueID] = true
+	return nil
+}
+
+func (s *MQTTSink) Close() error {
+	return s.mc.Close()
+}
@@ -0,0 +1,160 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// fakeMQTTConn is the broker's end of a client connection.
+type fakeMQTTConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// listenFakeMQTT accepts connections, acknowledging each CONNECT, and sends
+// them to conns.
+func listenFakeMQTT(t *testing.T) (net.Listener, <-chan fakeMQTTConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make(chan fakeMQTTConn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			fc := fakeMQTTConn{conn, bufio.NewReader(conn)}
+			if header, _, err := fc.readPacket(); err != nil || header != 0x10 {
+				t.Errorf("expected CONNECT, got %#x: %v", header, err)
+				conn.Close()
+				continue
+			}
+			conn.Write([]byte{0x20, 2, 0, 0})
+			conns <- fc
+		}
+	}()
+
+	return ln, conns
+}
+
+// readPacket reads a packet's first byte and body.
+func (fc fakeMQTTConn) readPacket() (header byte, body []byte, err error) {
+	if header, err = fc.r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+
+	n, shift := 0, uint(0)
+	for {
+		b, err := fc.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, n)
+	_, err = io.ReadFull(fc.r, body)
+	return header, body, err
+}
+
+// expectPublish reads a PUBLISH packet, failing unless it is to topic.
+func (fc fakeMQTTConn) expectPublish(t *testing.T, topic string) {
+	t.Helper()
+
+	header, body, err := fc.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %+v", err)
+	}
+	if header&0xf0 != 0x30 || len(body) < 2 {
+		t.Fatalf("expected PUBLISH, got %#x", header)
+	}
+	if n := int(body[0])<<8 | int(body[1]); string(body[2:2+n]) != topic {
+		t.Fatalf("published to %q, want %q", body[2:2+n], topic)
+	}
+}
+
+// TestMQTTSinkReconnect checks that the sink redials once its connection is
+// lost, and announces meters to Home Assistant again.
+func TestMQTTSinkReconnect(t *testing.T) {
+	ln, conns := listenFakeMQTT(t)
+	defer ln.Close()
+
+	accept := func() fakeMQTTConn {
+		select {
+		case fc := <-conns:
+			return fc
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for connection")
+		}
+		return fakeMQTTConn{}
+	}
+
+	sink, err := NewMQTTSink("mqtt://"+ln.Addr().String(), "homeassistant", "json")
+	if err != nil {
+		t.Fatalf("NewMQTTSink: %+v", err)
+	}
+	defer sink.Close()
+
+	msgType := msgTypeName("cumulative")
+	tags := map[string]string{"protocol": "SCM", "endpoint_id": "1", "endpoint_type": "4", "msg_type": msgType}
+	pts := []*write.Point{write.NewPoint("rtlamr", tags, map[string]interface{}{"consumption": int64(1)}, testTime)}
+
+	const configTopic = "homeassistant/sensor/rtlamr_scm_1/config"
+	stateTopic := "rtlamr/scm/1/" + msgType
+
+	fc := accept()
+	if err := sink.WritePoints(pts); err != nil {
+		t.Fatalf("WritePoints: %+v", err)
+	}
+	fc.expectPublish(t, configTopic)
+	fc.expectPublish(t, stateTopic)
+
+	// The broker drops the connection.
+	fc.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.mc.err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("lost connection wasn't noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := sink.WritePoints(pts); err != nil {
+		t.Fatalf("WritePoints: %+v", err)
+	}
+	fc = accept()
+	defer fc.Close()
+	fc.expectPublish(t, configTopic)
+	fc.expectPublish(t, stateTopic)
+}
@@ -0,0 +1,478 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/xerrors"
+)
+
+// natsTimeout bounds connecting to the server and waiting for replies.
+const natsTimeout = 5 * time.Second
+
+// natsSubjectPrefix is the first token of every subject published to.
+const natsSubjectPrefix = "rtlamr"
+
+// PointPayload is the encoding of a point published to a message bus. In
+// msgpack, the keys are the same as in json and the time is a msgpack
+// timestamp.
+type PointPayload struct {
+	Measurement string                 `json:"measurement" msgpack:"measurement"`
+	Time        time.Time              `json:"time" msgpack:"time"`
+	Tags        map[string]string      `json:"tags" msgpack:"tags"`
+	Fields      map[string]interface{} `json:"fields" msgpack:"fields"`
+}
+
+// NewPointPayload converts a point to its message bus encoding.
+func NewPointPayload(pt *write.Point) PointPayload {
+	payload := PointPayload{
+		Measurement: pt.Name(),
+		Time:        pt.Time(),
+		Tags:        map[string]string{},
+		Fields:      map[string]interface{}{},
+	}
+	for _, tag := range pt.TagList() {
+		payload.Tags[tag.Key] = tag.Value
+	}
+	for _, field := range pt.FieldList() {
+		payload.Fields[field.Key] = field.Value
+	}
+	return payload
+}
+
+// Marshal encodes the payload in format, either json or msgpack.
+func (payload PointPayload) Marshal(format string) ([]byte, error) {
+	if format == "msgpack" {
+		return msgpack.Marshal(payload)
+	}
+	return json.Marshal(payload)
+}
+
+// natsConn is a minimal client for the NATS core protocol, supporting only
+// what NATSSink needs: publishing and request/reply.
+type natsConn struct {
+	conn net.Conn
+	w    *bufio.Writer
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	sid     int
+	subs    map[string]chan []byte
+	pong    chan struct{}
+	lastErr error
+}
+
+func dialNATS(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, xerrors.Errorf("url.Parse: %w", err)
+	}
+	if u.Scheme != "nats" {
+		return nil, xerrors.Errorf("unsupported scheme %q, expected nats", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return nil, xerrors.Errorf("net.DialTimeout: %w", err)
+	}
+
+	return newNATSConn(conn, u.User)
+}
+
+// newNATSConn performs the protocol handshake on conn, authenticating with
+// user if given, and starts handling messages from the server.
+func newNATSConn(conn net.Conn, user *url.Userinfo) (*natsConn, error) {
+	nc := &natsConn{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		subs: map[string]chan []byte{},
+		pong: make(chan struct{}, 1),
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(natsTimeout))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, xerrors.Errorf("expected INFO from server: %q %v", info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "rtlamr-collect",
+		"lang":     "go",
+		"version":  version,
+		"protocol": 1,
+	}
+	if user != nil {
+		if pass, ok := user.Password(); ok {
+			opts["user"] = user.Username()
+			opts["pass"] = pass
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return nil, xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	go nc.read(r)
+
+	nc.wmu.Lock()
+	fmt.Fprintf(nc.w, "CONNECT %s\r\nPING\r\n", connect)
+	err = nc.w.Flush()
+	nc.wmu.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, xerrors.Errorf("w.Flush: %w", err)
+	}
+
+	// The server replies to PING with PONG once CONNECT is accepted, or with
+	// -ERR and closes the connection if not.
+	select {
+	case <-nc.pong:
+	case <-time.After(natsTimeout):
+		conn.Close()
+		return nil, xerrors.New("timed out waiting for server")
+	}
+
+	if err := nc.err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return nc, nil
+}
+
+// read handles messages from the server until the connection is closed.
+func (nc *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			nc.setErr(xerrors.Errorf("connection lost: %w", err))
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "PING":
+			nc.wmu.Lock()
+			nc.w.WriteString("PONG\r\n")
+			nc.w.Flush()
+			nc.wmu.Unlock()
+		case line == "PONG":
+			select {
+			case nc.pong <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			msg := strings.Trim(strings.TrimSpace(line[4:]), "'")
+			if !natsFatalErr(msg) {
+				log.Warnf("nats: server error: %s", msg)
+				continue
+			}
+
+			nc.setErr(xerrors.Errorf("server error: %s", msg))
+			select {
+			case nc.pong <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			args := strings.Fields(line)
+			if len(args) != 4 && len(args) != 5 {
+				nc.setErr(xerrors.Errorf("invalid MSG %q", line))
+				nc.conn.Close()
+				return
+			}
+
+			size, err := strconv.Atoi(args[len(args)-1])
+			if err != nil || size < 0 {
+				nc.setErr(xerrors.Errorf("invalid MSG %q", line))
+				nc.conn.Close()
+				return
+			}
+
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				nc.setErr(xerrors.Errorf("connection lost: %w", err))
+				return
+			}
+
+			nc.mu.Lock()
+			ch := nc.subs[args[2]]
+			nc.mu.Unlock()
+			if ch != nil {
+				select {
+				case ch <- payload[:size]:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// natsFatalErr reports whether the server closes the connection after sending
+// the error msg. Others, such as permission violations and invalid subjects,
+// only affect the operation which caused them.
+func natsFatalErr(msg string) bool {
+	msg = strings.ToLower(msg)
+	return !strings.HasPrefix(msg, "permissions violation") &&
+		!strings.HasPrefix(msg, "invalid subject")
+}
+
+func (nc *natsConn) setErr(err error) {
+	nc.mu.Lock()
+	nc.lastErr = err
+	nc.mu.Unlock()
+}
+
+func (nc *natsConn) err() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.lastErr
+}
+
+// Publish sends data to subject without waiting for acknowledgement.
+func (nc *natsConn) Publish(subject string, data []byte) error {
+	return nc.publish(subject, "", data)
+}
+
+func (nc *natsConn) publish(subject, reply string, data []byte) error {
+	if err := nc.err(); err != nil {
+		return err
+	}
+
+	nc.wmu.Lock()
+	defer nc.wmu.Unlock()
+
+	if reply != "" {
+		fmt.Fprintf(nc.w, "PUB %s %s %d\r\n", subject, reply, len(data))
+	} else {
+		fmt.Fprintf(nc.w, "PUB %s %d\r\n", subject, len(data))
+	}
+	nc.w.Write(data)
+	nc.w.WriteString("\r\n")
+
+	return nc.w.Flush()
+}
+
+// Request publishes data to subject and waits for a single reply.
+func (nc *natsConn) Request(subject string, data []byte) ([]byte, error) {
+	nc.mu.Lock()
+	nc.sid++
+	sid := strconv.Itoa(nc.sid)
+	ch := make(chan []byte, 1)
+	nc.subs[sid] = ch
+	nc.mu.Unlock()
+
+	defer func() {
+		nc.mu.Lock()
+		delete(nc.subs, sid)
+		nc.mu.Unlock()
+	}()
+
+	inbox := "_INBOX.rtlamr-collect." + sid
+
+	nc.wmu.Lock()
+	fmt.Fprintf(nc.w, "SUB %s %s\r\nUNSUB %s 1\r\n", inbox, sid, sid)
+	nc.wmu.Unlock()
+
+	if err := nc.publish(subject, inbox, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-time.After(natsTimeout):
+		if err := nc.err(); err != nil {
+			return nil, err
+		}
+		return nil, xerrors.Errorf("timed out waiting for reply on %s", subject)
+	}
+}
+
+func (nc *natsConn) Close() error {
+	nc.wmu.Lock()
+	nc.w.Flush()
+	nc.wmu.Unlock()
+	return nc.conn.Close()
+}
+
+// jsResponse is the common part of JetStream API responses.
+type jsResponse struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func (r jsResponse) err() error {
+	if r.Error == nil {
+		return nil
+	}
+	return xerrors.Errorf("jetstream: %s (%d)", r.Error.Description, r.Error.Code)
+}
+
+// NATSSink publishes each point as json or msgpack to
+// rtlamr.<protocol>.<endpoint_id>. If a stream is given, points are persisted
+// with JetStream and each publish waits for the server's acknowledgement. The
+// connection is re-established before a write if the server closed it.
+type NATSSink struct {
+	url    string
+	nc     *natsConn
+	stream string
+	format string
+}
+
+func NewNATSSink(rawurl, stream, format string) (*NATSSink, error) {
+	nc, err := dialNATS(rawurl)
+	if err != nil {
+		return nil, xerrors.Errorf("dialNATS: %w", err)
+	}
+
+	s := &NATSSink{url: rawurl, nc: nc, stream: stream, format: format}
+	if stream != "" {
+		if err := s.ensureStream(); err != nil {
+			nc.Close()
+			return nil, xerrors.Errorf("ensureStream: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// ensureStream creates the stream capturing all published subjects if it
+// doesn't exist.
+func (s *NATSSink) ensureStream() error {
+	reply, err := s.nc.Request("$JS.API.STREAM.INFO."+s.stream, nil)
+	if err != nil {
+		return xerrors.Errorf("nc.Request: %w", err)
+	}
+
+	var info jsResponse
+	if err := json.Unmarshal(reply, &info); err != nil {
+		return xerrors.Errorf("json.Unmarshal: %w", err)
+	}
+	if info.Error == nil {
+		return nil
+	}
+	if info.Error.Code != 404 {
+		return info.err()
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"name":     s.stream,
+		"subjects": []string{natsSubjectPrefix + ".>"},
+		"storage":  "file",
+	})
+	if err != nil {
+		return xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	reply, err = s.nc.Request("$JS.API.STREAM.CREATE."+s.stream, config)
+	if err != nil {
+		return xerrors.Errorf("nc.Request: %w", err)
+	}
+
+	var created jsResponse
+	if err := json.Unmarshal(reply, &created); err != nil {
+		return xerrors.Errorf("json.Unmarshal: %w", err)
+	}
+	if err := created.err(); err != nil {
+		return err
+	}
+
+	log.Printf("created jetstream stream %q", s.stream)
+	return nil
+}
+
+func (s *NATSSink) WritePoints(pts []*write.Point) error {
+	if err := s.nc.err(); err != nil {
+		log.Warnf("nats: %+v, reconnecting", err)
+
+		s.nc.Close()
+		nc, err := dialNATS(s.url)
+		if err != nil {
+			return xerrors.Errorf("dialNATS: %w", err)
+		}
+		s.nc = nc
+	}
+
+	for _, pt := range pts {
+		payload := NewPointPayload(pt)
+		data, err := payload.Marshal(s.format)
+		if err != nil {
+			return xerrors.Errorf("payload.Marshal: %w", err)
+		}
+
+		subject := strings.Join([]string{
+			natsSubjectPrefix,
+			payload.Tags["protocol"],
+			payload.Tags["endpoint_id"],
+		}, ".")
+
+		if s.stream == "" {
+			if err := s.nc.Publish(subject, data); err != nil {
+				return xerrors.Errorf("nc.Publish: %w", err)
+			}
+			continue
+		}
+
+		reply, err := s.nc.Request(subject, data)
+		if err != nil {
+			return xerrors.Errorf("nc.Request: %w", err)
+		}
+
+		var ack jsResponse
+		if err := json.Unmarshal(reply, &ack); err != nil {
+			return xerrors.Errorf("json.Unmarshal: %w", err)
+		}
+		if err := ack.err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NATSSink) Close() error {
+	return s.nc.Close()
+}
@@ -0,0 +1,143 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATSServer is the server end of a net.Pipe speaking just enough of the
+// NATS protocol for a natsConn to connect.
+type fakeNATSServer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newFakeNATS returns a natsConn connected to a fake server.
+func newFakeNATS(t *testing.T) (*natsConn, *fakeNATSServer) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	srv := &fakeNATSServer{t, server, bufio.NewReader(server)}
+	server.SetDeadline(time.Now().Add(natsTimeout))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.send("INFO {}")
+		srv.expect("CONNECT ")
+		srv.expect("PING")
+		srv.send("PONG")
+	}()
+
+	nc, err := newNATSConn(client, nil)
+	<-done
+	if err != nil {
+		t.Fatalf("newNATSConn: %+v", err)
+	}
+	return nc, srv
+}
+
+func (srv *fakeNATSServer) send(line string) {
+	if _, err := srv.conn.Write([]byte(line + "\r\n")); err != nil {
+		srv.t.Errorf("conn.Write: %+v", err)
+	}
+}
+
+func (srv *fakeNATSServer) expect(prefix string) {
+	line, err := srv.r.ReadString('\n')
+	if err != nil {
+		srv.t.Errorf("r.ReadString: %+v", err)
+		return
+	}
+	if !strings.HasPrefix(line, prefix) {
+		srv.t.Errorf("got %q, want %q", line, prefix)
+	}
+}
+
+// sync waits for the client to handle everything sent before it.
+func (srv *fakeNATSServer) sync() {
+	srv.send("PING")
+	srv.expect("PONG")
+}
+
+func TestNATSConnErrors(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Line  string
+		Fatal bool
+	}{
+		{"permissions violation", `-ERR 'Permissions Violation for Publish to "rtlamr.SCM.1"'`, false},
+		{"invalid subject", `-ERR 'Invalid Subject'`, false},
+		{"authorization violation", `-ERR 'Authorization Violation'`, true},
+		{"stale connection", `-ERR 'Stale Connection'`, true},
+		{"short MSG", `MSG rtlamr.SCM.1 5`, true},
+		{"negative MSG size", `MSG rtlamr.SCM.1 1 -1`, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			nc, srv := newFakeNATS(t)
+			defer nc.Close()
+
+			srv.send(c.Line)
+			if !c.Fatal {
+				srv.sync()
+				if err := nc.err(); err != nil {
+					t.Fatalf("recoverable error closed the connection: %+v", err)
+				}
+				return
+			}
+
+			// Nothing is sent back for these, so poll until the reader
+			// records the error.
+			deadline := time.Now().Add(natsTimeout)
+			for nc.err() == nil && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if nc.err() == nil {
+				t.Fatal("fatal error was ignored")
+			}
+		})
+	}
+}
+
+func TestNATSConnRequest(t *testing.T) {
+	nc, srv := newFakeNATS(t)
+	defer nc.Close()
+
+	go func() {
+		srv.expect("SUB _INBOX.rtlamr-collect.1 1")
+		srv.expect("UNSUB 1 1")
+		srv.expect("PUB rtlamr.SCM.1 _INBOX.rtlamr-collect.1 4")
+		srv.expect("data")
+		srv.send("MSG _INBOX.rtlamr-collect.1 1 2")
+		srv.send("ok")
+	}()
+
+	reply, err := nc.Request("rtlamr.SCM.1", []byte("data"))
+	if err != nil {
+		t.Fatalf("nc.Request: %+v", err)
+	}
+	if string(reply) != "ok" {
+		t.Errorf("got reply %q, want %q", reply, "ok")
+	}
+}
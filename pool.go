@@ -0,0 +1,101 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+// Decoded is a line of input and the message decoded from it.
+type Decoded struct {
+	Line
+
+	LogMsg LogMessage
+	Msg    Message
+
+	// ParseErr is the error parsing the log message, DecodeErr the error
+	// decoding the message it encapsulates.
+	ParseErr  error
+	DecodeErr error
+}
+
+// decodeLines decodes lines using the given number of workers, sending the
+// results to out in the order the lines were received. Lines without data
+// are passed through. out is closed once lines is. Closing done stops the
+// workers, abandoning lines in flight, for a caller which stops reading out.
+//
+// Only parsing and decoding are done by the workers. Building points stays in
+// the main loop since it reads and updates each meter's state, such as the
+// intervals already written and the last reading, which depends on messages
+// being handled one at a time in order. BenchmarkDecodeLines measures the
+// speedup on a given machine.
+func decodeLines(lines <-chan Line, out chan<- Decoded, workers int, decode func(Line) Decoded, done <-chan struct{}) {
+	type job struct {
+		line   Line
+		result chan Decoded
+	}
+
+	// Workers never block, since each result is buffered, so they exit once
+	// jobs is closed.
+	jobs := make(chan job)
+	defer close(jobs)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				j.result <- decode(j.line)
+			}
+		}()
+	}
+
+	// Results are collected in the order jobs were started, allowing up to
+	// twice as many lines in flight as there are workers.
+	pending := make(chan chan Decoded, 2*workers)
+	defer close(pending)
+	go func() {
+		for result := range pending {
+			var d Decoded
+			select {
+			case d = <-result:
+			case <-done:
+				return
+			}
+
+			select {
+			case out <- d:
+			case <-done:
+				return
+			}
+		}
+		close(out)
+	}()
+
+	for {
+		var line Line
+		var ok bool
+		select {
+		case line, ok = <-lines:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+
+		result := make(chan Decoded, 1)
+		select {
+		case pending <- result:
+		case <-done:
+			return
+		}
+		jobs <- job{line, result}
+	}
+}
@@ -0,0 +1,174 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"golang.org/x/xerrors"
+)
+
+// decodeTestLine parses and decodes a line the way the collector does.
+func decodeTestLine(mm MeterMap, cfg Config) func(Line) Decoded {
+	return func(line Line) (d Decoded) {
+		d.Line = line
+		if line.Data == nil {
+			return d
+		}
+		if d.ParseErr = json.Unmarshal(line.Data, &d.LogMsg); d.ParseErr == nil {
+			d.Msg, d.DecodeErr = decodeMessage(d.LogMsg, mm, cfg)
+		}
+		return d
+	}
+}
+
+// idmTestLine is an IDM message from meter id with a full set of intervals.
+func idmTestLine(id int) []byte {
+	intervals := make([]int, 47)
+	for i := range intervals {
+		intervals[i] = i
+	}
+	data, _ := json.Marshal(intervals)
+	return []byte(fmt.Sprintf(`{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":%d,"ConsumptionIntervalCount":2,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":%s,"TransmitTimeOffset":16}}`, id, data))
+}
+
+func TestDecodeLinesOrder(t *testing.T) {
+	mm := newTestMeterMap(t)
+	defer mm.Close()
+
+	lines := make(chan Line)
+	out := make(chan Decoded)
+	go decodeLines(lines, out, 4, decodeTestLine(mm, testConfig()), nil)
+
+	go func() {
+		for i := 1; i <= 1000; i++ {
+			lines <- Line{Source: strconv.Itoa(i), Data: idmTestLine(i)}
+			if i%100 == 0 {
+				lines <- Line{Source: "eof"}
+			}
+		}
+		close(lines)
+	}()
+
+	var n int
+	for d := range out {
+		if d.Data == nil {
+			continue
+		}
+		n++
+
+		if d.ParseErr != nil || d.DecodeErr != nil {
+			t.Fatalf("line %d: %+v %+v", n, d.ParseErr, d.DecodeErr)
+		}
+		if d.Source != strconv.Itoa(n) {
+			t.Fatalf("got line %s, want %d", d.Source, n)
+		}
+		if id := d.Msg.Meter("IDM").EndpointID; id != uint32(n) {
+			t.Fatalf("line %d decoded meter %d", n, id)
+		}
+	}
+	if n != 1000 {
+		t.Errorf("got %d lines, want 1000", n)
+	}
+}
+
+// repeatReader endlessly repeats line, like an input which is never
+// exhausted.
+type repeatReader struct {
+	line []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		c := copy(p[n:], r.line[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.line)
+	}
+	return n, nil
+}
+
+// failSink fails every write.
+type failSink struct{}
+
+func (failSink) WritePoints([]*write.Point) error { return xerrors.New("write failed") }
+func (failSink) Close() error                     { return nil }
+
+// TestProcessStopsWorkers checks that the goroutines reading and decoding
+// lines exit when process returns on error with input remaining.
+func TestProcessStopsWorkers(t *testing.T) {
+	mm := newTestMeterMap(t)
+	defer mm.Close()
+
+	cfg := testConfig()
+	cfg.MaxLineBytes = 1 << 20
+	cfg.Workers = 4
+
+	before := runtime.NumGoroutine()
+
+	input := &repeatReader{line: append(idmTestLine(1), '\n')}
+	if err := process([]Input{{ReadCloser: ioutil.NopCloser(input)}}, failSink{}, mm, cfg); err == nil {
+		t.Fatal("process succeeded writing to a failing sink")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left running, %d before process:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkDecodeLines measures decoding full IDM messages with each number
+// of workers. Run it with -cpu to compare on machines with more cores.
+func BenchmarkDecodeLines(b *testing.B) {
+	data := make([][]byte, 1024)
+	for i := range data {
+		data[i] = idmTestLine(i)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			mm, err := NewMeterMap("", false)
+			if err != nil {
+				b.Fatalf("NewMeterMap: %+v", err)
+			}
+			defer mm.Close()
+
+			lines := make(chan Line)
+			out := make(chan Decoded)
+			go decodeLines(lines, out, workers, decodeTestLine(mm, testConfig()), nil)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					lines <- Line{Data: data[i%len(data)]}
+				}
+				close(lines)
+			}()
+
+			for range out {
+			}
+		})
+	}
+}
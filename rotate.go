@@ -0,0 +1,135 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// backupLayout is the suffix of rotated files. It sorts chronologically and
+// avoids characters which aren't allowed in Windows file names.
+const backupLayout = "2006-01-02T15-04-05.000000000"
+
+// RotatingFile is a file which is rotated once it reaches a size or the local
+// date changes. Rotated files are renamed with the time of rotation appended.
+type RotatingFile struct {
+	// MaxSize is the size in bytes at which the file is rotated, zero is
+	// unlimited.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, zero keeps all of them.
+	MaxBackups int
+	// Daily rotates the file when the local date changes.
+	Daily bool
+
+	path string
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	day  string
+}
+
+// OpenRotatingFile opens or creates the file at path for appending.
+func OpenRotatingFile(path string) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() (err error) {
+	rf.f, err = os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return xerrors.Errorf("os.OpenFile: %w", err)
+	}
+
+	fi, err := rf.f.Stat()
+	if err != nil {
+		return xerrors.Errorf("f.Stat: %w", err)
+	}
+
+	rf.size = fi.Size()
+	rf.day = fi.ModTime().Format("2006-01-02")
+
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	now := time.Now()
+	full := rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize
+	if full || (rf.Daily && now.Format("2006-01-02") != rf.day) {
+		if err := rf.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	rf.day = now.Format("2006-01-02")
+
+	return n, err
+}
+
+// rotate renames the current file and opens a new one, removing the oldest
+// backups beyond MaxBackups.
+func (rf *RotatingFile) rotate(now time.Time) error {
+	if err := rf.f.Close(); err != nil {
+		return xerrors.Errorf("f.Close: %w", err)
+	}
+
+	if err := os.Rename(rf.path, rf.path+"."+now.Format(backupLayout)); err != nil {
+		return xerrors.Errorf("os.Rename: %w", err)
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	if rf.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(rf.path + ".*-*-*T*")
+	if err != nil {
+		return xerrors.Errorf("filepath.Glob: %w", err)
+	}
+	sort.Strings(backups)
+
+	for len(backups) > rf.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return xerrors.Errorf("os.Remove: %w", err)
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,221 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"golang.org/x/xerrors"
+)
+
+// selfTestCase is a sample message from rtlamr and the points it must produce
+// with the default configuration, in order.
+type selfTestCase struct {
+	Name string
+	Line string
+	Want []selfTestPoint
+}
+
+type selfTestPoint struct {
+	Tags   map[string]string
+	Fields map[string]interface{}
+}
+
+// selfTestCases double as documentation of how each protocol's fields are
+// mapped to points.
+var selfTestCases = []selfTestCase{
+	{
+		Name: "SCM",
+		Line: `{"Time":"2020-01-01T10:00:00Z","Type":"SCM","Message":{"ID":1,"Type":4,"TamperPhy":0,"TamperEnc":0,"Consumption":5,"ChecksumVal":0}}`,
+		Want: []selfTestPoint{
+			{
+				Tags:   map[string]string{"protocol": "SCM", "msg_type": "cumulative", "endpoint_type": "4", "endpoint_id": "1"},
+				Fields: map[string]interface{}{"consumption": int64(5)},
+			},
+		},
+	},
+	{
+		Name: "SCM+",
+		Line: `{"Time":"2020-01-01T10:00:00Z","Type":"SCM+","Message":{"FrameSync":5795,"ProtocolID":30,"EndpointType":156,"EndpointID":2,"Consumption":7,"Tamper":0,"PacketCRC":0}}`,
+		Want: []selfTestPoint{
+			{
+				Tags:   map[string]string{"protocol": "SCM+", "msg_type": "cumulative", "endpoint_type": "156", "endpoint_id": "2"},
+				Fields: map[string]interface{}{"consumption": int64(7)},
+			},
+		},
+	},
+	{
+		Name: "IDM",
+		Line: `{"Time":"2020-01-01T10:00:00Z","Type":"IDM","Message":{"ERTType":7,"ERTSerialNumber":3,"ConsumptionIntervalCount":2,"PowerOutageFlags":"AAAAAAAA","LastConsumptionCount":100,"DifferentialConsumptionIntervals":[1,2],"TransmitTimeOffset":16}}`,
+		Want: []selfTestPoint{
+			{
+				Tags:   map[string]string{"protocol": "IDM", "msg_type": "cumulative", "endpoint_type": "7", "endpoint_id": "3"},
+				Fields: map[string]interface{}{"consumption": int64(100)},
+			},
+			{
+				Tags:   map[string]string{"protocol": "IDM", "msg_type": "differential", "endpoint_type": "7", "endpoint_id": "3"},
+				Fields: map[string]interface{}{"consumption": int64(1), "interval": int64(2)},
+			},
+			{
+				Tags:   map[string]string{"protocol": "IDM", "msg_type": "differential", "endpoint_type": "7", "endpoint_id": "3"},
+				Fields: map[string]interface{}{"consumption": int64(2), "interval": int64(1)},
+			},
+		},
+	},
+	{
+		Name: "NetIDM",
+		Line: `{"Time":"2020-01-01T10:00:00Z","Type":"NetIDM","Message":{"ERTType":8,"ERTSerialNumber":4,"ConsumptionIntervalCount":2,"LastConsumption":500,"LastConsumptionNet":400,"LastGeneration":100,"DifferentialConsumptionIntervals":[1],"TransmitTimeOffset":16}}`,
+		Want: []selfTestPoint{
+			{
+				Tags:   map[string]string{"protocol": "NetIDM", "msg_type": "cumulative", "endpoint_type": "8", "endpoint_id": "4"},
+				Fields: map[string]interface{}{"consumption": int64(500), "consumption_net": int64(400), "generation": int64(100)},
+			},
+			{
+				Tags:   map[string]string{"protocol": "NetIDM", "msg_type": "differential", "endpoint_type": "8", "endpoint_id": "4"},
+				Fields: map[string]interface{}{"consumption": int64(1), "interval": int64(2)},
+			},
+		},
+	},
+	{
+		Name: "R900",
+		Line: `{"Time":"2020-01-01T10:00:00Z","Type":"R900","Message":{"ID":5,"Unkn1":163,"NoUse":1,"BackFlow":2,"Consumption":1234,"Unkn3":0,"Leak":3,"LeakNow":1}}`,
+		Want: []selfTestPoint{
+			{
+				Tags: map[string]string{"protocol": "R900", "msg_type": "cumulative", "endpoint_type": "163", "endpoint_id": "5"},
+				Fields: map[string]interface{}{
+					"consumption": int64(1234),
+					"nouse":       int64(1),
+					"backflow":    int64(2),
+					"leak":        int64(3),
+					"leak_now":    int64(1),
+					"gallons":     float64(1234),
+				},
+			},
+		},
+	},
+}
+
+// selfTest decodes every sample message and checks the points it produces,
+// writing a report to w. It reports whether every case passed. It must run
+// before the configuration is loaded, as samples are checked against the
+// default field mapping.
+func selfTest(w io.Writer) bool {
+	passed := true
+	for _, c := range selfTestCases {
+		if err := c.run(); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", c.Name, err)
+			passed = false
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s\n", c.Name)
+	}
+
+	return passed
+}
+
+// run decodes the case's sample and writes its points to a discarding sink.
+func (c selfTestCase) run() error {
+	mm, err := NewMeterMap("", false)
+	if err != nil {
+		return xerrors.Errorf("NewMeterMap: %w", err)
+	}
+	defer mm.Close()
+
+	var logMsg LogMessage
+	if err := json.Unmarshal([]byte(c.Line), &logMsg); err != nil {
+		return xerrors.Errorf("json.Unmarshal: %w", err)
+	}
+
+	cfg := Config{
+		Enabled:            map[string]bool{logMsg.Type: true},
+		IDMInterval:        5 * time.Minute,
+		R900GallonsPerUnit: 1,
+	}
+	msg, err := decodeMessage(logMsg, mm, cfg)
+	if err != nil {
+		return xerrors.Errorf("decodeMessage: %w", err)
+	}
+	if msg == nil {
+		return xerrors.New("message was ignored")
+	}
+
+	var got []selfTestPoint
+	var pts []*write.Point
+	msg.AddPoints(logMsg, func(t time.Time, tags map[string]string, fields map[string]interface{}) {
+		// Messages may re-use tags between points.
+		pt := selfTestPoint{map[string]string{}, map[string]interface{}{}}
+		for k, v := range tags {
+			pt.Tags[k] = v
+		}
+		for k, v := range fields {
+			pt.Fields[k] = v
+		}
+		got = append(got, pt)
+		pts = append(pts, newPoint("selftest", tags, fields, t))
+	})
+	if err := (DiscardSink{}).WritePoints(pts); err != nil {
+		return xerrors.Errorf("WritePoints: %w", err)
+	}
+
+	if len(got) != len(c.Want) {
+		return xerrors.Errorf("got %d points, want %d", len(got), len(c.Want))
+	}
+	for i, want := range c.Want {
+		if diff := got[i].diff(want); diff != "" {
+			return xerrors.Errorf("point %d: %s", i, diff)
+		}
+	}
+
+	return nil
+}
+
+// diff describes how pt differs from want, or is empty if they are equal.
+func (pt selfTestPoint) diff(want selfTestPoint) string {
+	var diffs []string
+	for k, v := range want.Tags {
+		if got, ok := pt.Tags[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("missing tag %s", k))
+		} else if got != v {
+			diffs = append(diffs, fmt.Sprintf("tag %s=%q, want %q", k, got, v))
+		}
+	}
+	for k := range pt.Tags {
+		if _, ok := want.Tags[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected tag %s", k))
+		}
+	}
+	for k, v := range want.Fields {
+		if got, ok := pt.Fields[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("missing field %s", k))
+		} else if got != v {
+			diffs = append(diffs, fmt.Sprintf("field %s=%v (%T), want %v (%T)", k, got, got, v, v))
+		}
+	}
+	for k := range pt.Fields {
+		if _, ok := want.Fields[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected field %s", k))
+		}
+	}
+	sort.Strings(diffs)
+
+	return strings.Join(diffs, ", ")
+}
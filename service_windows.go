@@ -0,0 +1,188 @@
+//go:build windows
+// +build windows
+
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"golang.org/x/xerrors"
+)
+
+const serviceName = "rtlamr-collect"
+
+// serviceStopTimeout is how long the service waits for remaining input to be
+// processed after being asked to stop.
+const serviceStopTimeout = 10 * time.Second
+
+// serviceMain handles the subcommands for running as a Windows service,
+// reporting whether args was one of them:
+//
+//	install <config>  installs the service, started automatically with config
+//	uninstall         removes the service
+//	service <config>  runs as the service, only used by the service manager
+func serviceMain(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		if len(args) != 2 {
+			log.Fatalln("usage: rtlamr-collect install <config>")
+		}
+		err = installService(args[1])
+	case "uninstall":
+		err = uninstallService()
+	case "service":
+		if len(args) != 2 {
+			log.Fatalln("usage: rtlamr-collect service <config>")
+		}
+		err = runService(args[1])
+	default:
+		return false
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	return true
+}
+
+func installService(config string) error {
+	config, err := filepath.Abs(config)
+	if err != nil {
+		return xerrors.Errorf("filepath.Abs: %w", err)
+	}
+	if _, err := os.Stat(config); err != nil {
+		return xerrors.Errorf("os.Stat: %w", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return xerrors.Errorf("os.Executable: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return xerrors.Errorf("mgr.Connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "rtlamr-collect",
+		Description: "Writes utility meter readings from rtlamr to InfluxDB.",
+		StartType:   mgr.StartAutomatic,
+	}, "service", config)
+	if err != nil {
+		return xerrors.Errorf("m.CreateService: %w", err)
+	}
+	defer s.Close()
+
+	// Restart the service if it exits on error, e.g. when InfluxDB is
+	// unreachable.
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return xerrors.Errorf("s.SetRecoveryActions: %w", err)
+	}
+
+	log.Printf("installed service %q using %q", serviceName, config)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return xerrors.Errorf("mgr.Connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return xerrors.Errorf("m.OpenService: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return xerrors.Errorf("s.Delete: %w", err)
+	}
+
+	log.Printf("removed service %q", serviceName)
+	return nil
+}
+
+// runService runs the collector as a Windows service. Services start in the
+// system directory, so the working directory is changed to the config file's
+// to keep meters.db beside it.
+func runService(config string) error {
+	if err := os.Chdir(filepath.Dir(config)); err != nil {
+		return xerrors.Errorf("os.Chdir: %w", err)
+	}
+	if err := os.Setenv("COLLECT_CONFIG", config); err != nil {
+		return xerrors.Errorf("os.Setenv: %w", err)
+	}
+
+	if err := svc.Run(serviceName, collectService{}); err != nil {
+		return xerrors.Errorf("svc.Run: %w", err)
+	}
+	return nil
+}
+
+type collectService struct{}
+
+func (collectService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		run()
+		close(done)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+
+				interrupt <- os.Interrupt
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+					log.Warn("timed out waiting for input to be processed")
+				}
+				return false, 0
+			}
+		}
+	}
+}
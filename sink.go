@@ -0,0 +1,444 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// Sink writes batches of points to their destination.
+type Sink interface {
+	WritePoints(pts []*write.Point) error
+	Close() error
+}
+
+// Pinger is implemented by sinks which can exercise their connection without
+// writing any data.
+type Pinger interface {
+	Ping() error
+}
+
+// Pender is implemented by sinks which write points in the background,
+// reporting how many are yet to be written.
+type Pender interface {
+	Pending() int
+}
+
+// errWriteTimeout is returned by InfluxDBSink when a write takes longer than
+// its timeout.
+var errWriteTimeout = xerrors.New("write timed out")
+
+// writeRetries is the number of times InfluxDBSink retries a write which timed
+// out before returning the error.
+const writeRetries = 5
+
+// InfluxDBSink writes points to bucket using the blocking write api. Writes
+// fail if they take longer than timeout, and are retried like those rejected
+// by the server's rate limit, waiting backoff at first and twice as long each
+// time.
+type InfluxDBSink struct {
+	client  influxdb2.Client
+	org     string
+	bucket  string
+	timeout time.Duration
+	backoff time.Duration
+
+	// async buffers points and writes them in the background instead, if not
+	// nil. Write errors are only logged.
+	async api.WriteAPI
+}
+
+func NewInfluxDBSink(client influxdb2.Client, org, bucket string, timeout time.Duration) *InfluxDBSink {
+	return &InfluxDBSink{client: client, org: org, bucket: bucket, timeout: timeout, backoff: time.Second}
+}
+
+// NewAsyncInfluxDBSink creates a sink using the non-blocking write api, which
+// batches points and retries failed writes.
+func NewAsyncInfluxDBSink(client influxdb2.Client, writeAPI api.WriteAPI, bucket string) *InfluxDBSink {
+	go func() {
+		for err := range writeAPI.Errors() {
+			if authErr := authError(err, bucket); authErr != nil {
+				err = authErr
+			}
+			log.Errorf("async write: %+v", err)
+		}
+	}()
+
+	return &InfluxDBSink{client: client, bucket: bucket, async: writeAPI}
+}
+
+// Ping requests the server's health, keeping the connection from going stale.
+func (s *InfluxDBSink) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	if _, err := s.client.Health(ctx); err != nil {
+		return xerrors.Errorf("client.Health: %w", err)
+	}
+	return nil
+}
+
+func (s *InfluxDBSink) WritePoints(pts []*write.Point) error {
+	if s.async != nil {
+		for _, pt := range pts {
+			s.async.WritePoint(pt)
+		}
+		return nil
+	}
+
+	// Rate limited writes aren't retried here, but by RateLimitedSink which
+	// backs off for as long as the server asks.
+	backoff := s.backoff
+	for retry := 0; ; retry++ {
+		err := s.write(pts)
+		if retry == writeRetries || !xerrors.Is(err, errWriteTimeout) {
+			return err
+		}
+
+		log.Warnf("%+v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *InfluxDBSink) write(pts []*write.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// The client's write api keeps batches rejected with 429 or a 5xx to
+	// resend before the next one, which would write them twice once retried
+	// by the caller. A new one for each write holds no rejected batches.
+	writeAPI := api.NewWriteAPIBlocking(s.org, s.bucket, s.client.HTTPService(), s.client.Options().WriteOptions())
+	err := writeAPI.WritePoint(ctx, pts...)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return xerrors.Errorf("api.WritePoint: %w after %s", errWriteTimeout, s.timeout)
+	}
+
+	// Batches the server rejects as too large are split in half and each
+	// half written separately, down to single points.
+	var httpErr *http2.Error
+	if xerrors.As(err, &httpErr) && httpErr.StatusCode == http.StatusRequestEntityTooLarge && len(pts) > 1 {
+		log.Debugf("batch of %d points too large, splitting", len(pts))
+		half := len(pts) / 2
+		if err := s.WritePoints(pts[:half]); err != nil {
+			return err
+		}
+		return s.WritePoints(pts[half:])
+	}
+
+	if authErr := authError(err, s.bucket); authErr != nil {
+		return authErr
+	}
+	if err != nil {
+		return xerrors.Errorf("api.WritePoint: %w", err)
+	}
+	return nil
+}
+
+// Close writes any points buffered by the async write api.
+func (s *InfluxDBSink) Close() error {
+	if s.async != nil {
+		s.async.Flush()
+	}
+	return nil
+}
+
+// LineProtocolSink writes points as InfluxDB line protocol, one per line.
+type LineProtocolSink struct {
+	w   *bufio.Writer
+	enc *lp.Encoder
+}
+
+func NewLineProtocolSink(w io.Writer) *LineProtocolSink {
+	buf := bufio.NewWriter(w)
+
+	enc := lp.NewEncoder(buf)
+	enc.SetFieldTypeSupport(lp.UintSupport)
+	enc.FailOnFieldErr(true)
+	enc.SetPrecision(time.Nanosecond)
+
+	return &LineProtocolSink{w: buf, enc: enc}
+}
+
+// WritePoints encodes each point and flushes the batch so downstream readers
+// receive it immediately.
+func (s *LineProtocolSink) WritePoints(pts []*write.Point) error {
+	for _, pt := range pts {
+		if _, err := s.enc.Encode(pt); err != nil {
+			return xerrors.Errorf("enc.Encode: %w", err)
+		}
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return xerrors.Errorf("w.Flush: %w", err)
+	}
+
+	return nil
+}
+
+func (s *LineProtocolSink) Close() error {
+	return s.w.Flush()
+}
+
+// NDJSONSink appends points to a file as newline-delimited JSON, one object
+// per point like those published by NATSSink.
+type NDJSONSink struct {
+	f   *RotatingFile
+	enc *json.Encoder
+}
+
+func NewNDJSONSink(f *RotatingFile) *NDJSONSink {
+	return &NDJSONSink{f: f, enc: json.NewEncoder(f)}
+}
+
+func (s *NDJSONSink) WritePoints(pts []*write.Point) error {
+	for _, pt := range pts {
+		if err := s.enc.Encode(NewPointPayload(pt)); err != nil {
+			return xerrors.Errorf("enc.Encode: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *NDJSONSink) Close() error {
+	return s.f.Close()
+}
+
+// udpPayloadSize limits the size of datagrams sent by UDPSink, small enough
+// to avoid fragmentation on most networks.
+const udpPayloadSize = 1400
+
+// UDPSink sends points as line protocol to InfluxDB's UDP listener. Delivery
+// is fire-and-forget, points lost in transit are not retried.
+type UDPSink struct {
+	conn net.Conn
+
+	line   bytes.Buffer
+	enc    *lp.Encoder
+	packet []byte
+}
+
+func NewUDPSink(addr string) (*UDPSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("net.Dial: %w", err)
+	}
+
+	s := &UDPSink{conn: conn}
+	s.enc = lp.NewEncoder(&s.line)
+	s.enc.SetFieldTypeSupport(lp.UintSupport)
+	s.enc.FailOnFieldErr(true)
+	s.enc.SetPrecision(time.Nanosecond)
+
+	return s, nil
+}
+
+// WritePoints packs as many whole lines as will fit into each datagram.
+func (s *UDPSink) WritePoints(pts []*write.Point) error {
+	s.packet = s.packet[:0]
+	for _, pt := range pts {
+		s.line.Reset()
+		if _, err := s.enc.Encode(pt); err != nil {
+			return xerrors.Errorf("enc.Encode: %w", err)
+		}
+
+		if len(s.packet) > 0 && len(s.packet)+s.line.Len() > udpPayloadSize {
+			if err := s.send(); err != nil {
+				return err
+			}
+		}
+		s.packet = append(s.packet, s.line.Bytes()...)
+	}
+
+	if len(s.packet) > 0 {
+		return s.send()
+	}
+	return nil
+}
+
+func (s *UDPSink) send() error {
+	_, err := s.conn.Write(s.packet)
+	s.packet = s.packet[:0]
+	if err != nil {
+		return xerrors.Errorf("conn.Write: %w", err)
+	}
+	return nil
+}
+
+func (s *UDPSink) Close() error {
+	return s.conn.Close()
+}
+
+// DiscardSink drops all points, used by COLLECT_INFLUXDB_DRYRUN.
+type DiscardSink struct{}
+
+func (DiscardSink) WritePoints(pts []*write.Point) error { return nil }
+
+func (DiscardSink) Close() error { return nil }
+
+// RateLimitedSink writes at most rate points per second to the next sink,
+// queueing up to queueSize points in the meantime. Points are written in the
+// background, so write errors are only logged. Writes InfluxDB rejects with
+// 429 Too Many Requests are retried after backing off.
+type RateLimitedSink struct {
+	next  Sink
+	rate  float64
+	queue chan *write.Point
+	done  chan struct{}
+
+	// backoff is the first wait before retrying a rate limited write, unless
+	// the server says how long to wait.
+	backoff time.Duration
+
+	dropped int
+}
+
+func NewRateLimitedSink(next Sink, rate float64, queueSize int) *RateLimitedSink {
+	s := &RateLimitedSink{
+		next:  next,
+		rate:  rate,
+		queue: make(chan *write.Point, queueSize),
+		done:  make(chan struct{}),
+
+		backoff: time.Second,
+	}
+	go s.run()
+	return s
+}
+
+// WritePoints queues points, dropping them if the queue is full.
+func (s *RateLimitedSink) WritePoints(pts []*write.Point) error {
+	for _, pt := range pts {
+		select {
+		case s.queue <- pt:
+		default:
+			s.dropped++
+		}
+	}
+
+	if s.dropped > 0 {
+		log.Warnf("write queue full, dropped %d points", s.dropped)
+		s.dropped = 0
+	}
+	return nil
+}
+
+// Ping passes through to the next sink, if it supports it.
+func (s *RateLimitedSink) Ping() error {
+	if pinger, ok := s.next.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// Pending returns the number of queued points.
+func (s *RateLimitedSink) Pending() int {
+	return len(s.queue)
+}
+
+// Close writes the queued points and closes the next sink.
+func (s *RateLimitedSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return s.next.Close()
+}
+
+// maxBackoff is the longest wait before retrying a write which was rejected
+// for exceeding the server's rate limit, or timed out.
+const maxBackoff = time.Minute
+
+// run is a token bucket holding up to one second of points. Each write takes
+// as many queued points as there are tokens.
+func (s *RateLimitedSink) run() {
+	defer close(s.done)
+
+	burst := int(math.Ceil(s.rate))
+	tokens := float64(burst)
+	last := time.Now()
+
+	for pt := range s.queue {
+		batch := []*write.Point{pt}
+	collect:
+		for len(batch) < burst {
+			select {
+			case pt, ok := <-s.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, pt)
+			default:
+				break collect
+			}
+		}
+
+		// Wait for enough tokens to write the whole batch.
+		now := time.Now()
+		tokens = math.Min(float64(burst), tokens+now.Sub(last).Seconds()*s.rate)
+		last = now
+		if need := float64(len(batch)) - tokens; need > 0 {
+			time.Sleep(time.Duration(need / s.rate * float64(time.Second)))
+			tokens += need
+			last = time.Now()
+		}
+		tokens -= float64(len(batch))
+
+		backoff := s.backoff
+		for {
+			err := s.next.WritePoints(batch)
+
+			var httpErr *http2.Error
+			if xerrors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+				wait := backoff
+				if httpErr.RetryAfter > 0 {
+					wait = time.Duration(httpErr.RetryAfter) * time.Second
+				}
+				log.Warnf("write rate limited by server, retrying in %s", wait)
+				time.Sleep(wait)
+
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+
+			if err != nil {
+				log.Errorf("%+v", xerrors.Errorf("next.WritePoints: %w", err))
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"golang.org/x/xerrors"
+)
+
+// TestInfluxDBSinkRetry checks that writes which time out are retried, and
+// that the error is returned once retries run out.
+func TestInfluxDBSinkRetry(t *testing.T) {
+	cases := []struct {
+		Name string
+		// Hangs is the number of writes which hang until they time out
+		// before one succeeds.
+		Hangs int
+		Err   error
+	}{
+		{"success", 0, nil},
+		{"timeout", 2, nil},
+		{"last retry", writeRetries, nil},
+		{"retries exhausted", writeRetries + 1, errWriteTimeout},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests int
+			)
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				n := requests
+				requests++
+				mu.Unlock()
+
+				if n >= c.Hangs {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				select {
+				case <-r.Context().Done():
+				case <-done:
+				}
+			}))
+			defer srv.Close()
+			// Hanging requests are released before the server is closed.
+			defer close(done)
+
+			client := influxdb2.NewClient(srv.URL, "token")
+			defer client.Close()
+
+			sink := NewInfluxDBSink(client, "org", "bucket", 50*time.Millisecond)
+			sink.backoff = time.Millisecond
+
+			pt := write.NewPoint("rtlamr", map[string]string{"protocol": "SCM"}, map[string]interface{}{"consumption": int64(1)}, testTime)
+			err := sink.WritePoints([]*write.Point{pt})
+			if c.Err == nil && err != nil || c.Err != nil && !xerrors.Is(err, c.Err) {
+				t.Fatalf("got error %+v, want %v", err, c.Err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			want := c.Hangs + 1
+			if want > writeRetries+1 {
+				want = writeRetries + 1
+			}
+			if requests != want {
+				t.Errorf("got %d requests, want %d", requests, want)
+			}
+		})
+	}
+}
+
+// TestRateLimitedSink429 checks that a batch rejected with 429 Too Many
+// Requests is written exactly once when retried, and not also resent by the
+// client.
+func TestRateLimitedSink429(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		written  []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		written = append(written, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client := influxdb2.NewClient(srv.URL, "token")
+	defer client.Close()
+
+	sink := NewRateLimitedSink(NewInfluxDBSink(client, "org", "bucket", time.Second), 1000, 10)
+	sink.backoff = time.Millisecond
+
+	pt := write.NewPoint("rtlamr", map[string]string{"protocol": "SCM"}, map[string]interface{}{"consumption": int64(1)}, testTime)
+	if err := sink.WritePoints([]*write.Point{pt}); err != nil {
+		t.Fatalf("WritePoints: %+v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close: %+v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 || len(written) != 1 {
+		t.Fatalf("got %d requests writing %q, want 2 requests and one write", requests, written)
+	}
+}
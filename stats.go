@@ -0,0 +1,69 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats counts activity for the periodic summary log.
+type Stats struct {
+	Since    time.Time
+	Meters   map[Meter]bool
+	Messages map[string]int
+	Points   int
+}
+
+// NewStats returns empty stats counted from now.
+func NewStats() *Stats {
+	return &Stats{
+		Since:    time.Now(),
+		Meters:   map[Meter]bool{},
+		Messages: map[string]int{},
+	}
+}
+
+// Message counts a message received from meter.
+func (s *Stats) Message(meter Meter) {
+	s.Meters[meter] = true
+	s.Messages[meter.Protocol]++
+}
+
+// Written counts points written to the sink.
+func (s *Stats) Written(n int) {
+	s.Points += n
+}
+
+// String summarizes the stats, e.g.:
+//
+//	meters=3 points=12 messages=10 (IDM=2 SCM=8) since 2020-01-01T00:00:00Z
+func (s *Stats) String() string {
+	protocols := make([]string, 0, len(s.Messages))
+	total := 0
+	for protocol, n := range s.Messages {
+		protocols = append(protocols, fmt.Sprintf("%s=%d", protocol, n))
+		total += n
+	}
+	sort.Strings(protocols)
+
+	return fmt.Sprintf("meters=%d points=%d messages=%d (%s) since %s",
+		len(s.Meters), s.Points, total, strings.Join(protocols, " "),
+		s.Since.UTC().Format(time.RFC3339),
+	)
+}
@@ -0,0 +1,358 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// timestreamTimeout bounds each request to Timestream.
+const timestreamTimeout = 30 * time.Second
+
+// timestreamMaxRecords is the most records WriteRecords accepts at once.
+const timestreamMaxRecords = 100
+
+// awsCredentials sign requests to AWS. SessionToken is only set for
+// temporary credentials.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// signV4 signs req with AWS Signature Version 4, adding the X-Amz-Date,
+// X-Amz-Security-Token and Authorization headers. Every header already set on
+// req is signed, so it must not be changed afterwards.
+func signV4(req *http.Request, body []byte, creds awsCredentials, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// timestreamDimension is a tag of a Timestream record.
+type timestreamDimension struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// timestreamRecord is a single measure of a Timestream record.
+type timestreamRecord struct {
+	Dimensions       []timestreamDimension `json:"Dimensions"`
+	MeasureName      string                `json:"MeasureName"`
+	MeasureValue     string                `json:"MeasureValue"`
+	MeasureValueType string                `json:"MeasureValueType"`
+	Time             string                `json:"Time"`
+	TimeUnit         string                `json:"TimeUnit"`
+}
+
+// timestreamValue formats a field value as a measure value and its type.
+// Empty strings are reported as false, since Timestream rejects them.
+func timestreamValue(value interface{}) (string, string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), "BIGINT", true
+	case uint64:
+		return strconv.FormatUint(v, 10), "BIGINT", true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), "DOUBLE", true
+	case bool:
+		return strconv.FormatBool(v), "BOOLEAN", true
+	case string:
+		return v, "VARCHAR", v != ""
+	}
+	return "", "", false
+}
+
+// timestreamRecords converts points to records, one per field. The point's
+// measurement and tags become the record's dimensions, with the measurement
+// named measurement. Empty tags are left out.
+func timestreamRecords(pts []*write.Point) []timestreamRecord {
+	var records []timestreamRecord
+	for _, pt := range pts {
+		dims := []timestreamDimension{{"measurement", pt.Name()}}
+		for _, tag := range pt.TagList() {
+			if tag.Value != "" {
+				dims = append(dims, timestreamDimension{tag.Key, tag.Value})
+			}
+		}
+
+		for _, field := range pt.FieldList() {
+			value, valueType, ok := timestreamValue(field.Value)
+			if !ok {
+				continue
+			}
+
+			records = append(records, timestreamRecord{
+				Dimensions:       dims,
+				MeasureName:      field.Key,
+				MeasureValue:     value,
+				MeasureValueType: valueType,
+				Time:             strconv.FormatInt(pt.Time().UnixNano(), 10),
+				TimeUnit:         "NANOSECONDS",
+			})
+		}
+	}
+	return records
+}
+
+// timestreamError is the body of a failed Timestream request.
+type timestreamError struct {
+	Type            string `json:"__type"`
+	Message         string `json:"message"`
+	RejectedRecords []struct {
+		RecordIndex int    `json:"RecordIndex"`
+		Reason      string `json:"Reason"`
+	} `json:"RejectedRecords"`
+}
+
+func (e timestreamError) Error() string {
+	msg := e.Type[strings.LastIndex(e.Type, "#")+1:] + ": " + e.Message
+	if len(e.RejectedRecords) > 0 {
+		rejected := e.RejectedRecords[0]
+		msg += fmt.Sprintf(" (record %d: %s)", rejected.RecordIndex, rejected.Reason)
+	}
+	return msg
+}
+
+// TimestreamSink writes each field of each point as a record to an AWS
+// Timestream table, signing requests with static credentials. Requests go to
+// the ingestion endpoint discovered from discoveryURL, which is looked up
+// again once its cache period is over.
+type TimestreamSink struct {
+	database     string
+	table        string
+	region       string
+	creds        awsCredentials
+	discoveryURL string
+
+	client   *http.Client
+	endpoint string
+	expires  time.Time
+}
+
+// NewTimestreamSink discovers the ingestion endpoint for region, or uses
+// endpoint for discovery instead if it isn't empty.
+func NewTimestreamSink(database, table, region, endpoint string, creds awsCredentials) (*TimestreamSink, error) {
+	if endpoint == "" {
+		endpoint = "https://ingest.timestream." + region + ".amazonaws.com"
+	}
+
+	s := &TimestreamSink{
+		database:     database,
+		table:        table,
+		region:       region,
+		creds:        creds,
+		discoveryURL: endpoint,
+		client:       &http.Client{Timeout: timestreamTimeout},
+	}
+	if err := s.discover(); err != nil {
+		return nil, xerrors.Errorf("discover: %w", err)
+	}
+
+	return s, nil
+}
+
+// call makes a Timestream API request to url, decoding the response into
+// resp if it isn't nil.
+func (s *TimestreamSink) call(url, target string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return xerrors.Errorf("http.NewRequest: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	httpReq.Header.Set("X-Amz-Target", "Timestream_20181101."+target)
+	signV4(httpReq, body, s.creds, s.region, "timestream", time.Now())
+
+	httpResp, err := s.client.Do(httpReq)
+	if err != nil {
+		return xerrors.Errorf("client.Do: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return xerrors.Errorf("ioutil.ReadAll: %w", err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		var apiErr timestreamError
+		if err := json.Unmarshal(data, &apiErr); err != nil || apiErr.Type == "" {
+			return xerrors.Errorf("%s: unexpected status %s", target, httpResp.Status)
+		}
+		return xerrors.Errorf("%s: %w", target, apiErr)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return xerrors.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
+
+// discover looks up the ingestion endpoint. Discovered addresses are used
+// with the discovery url's scheme.
+func (s *TimestreamSink) discover() error {
+	var resp struct {
+		Endpoints []struct {
+			Address              string `json:"Address"`
+			CachePeriodInMinutes int64  `json:"CachePeriodInMinutes"`
+		} `json:"Endpoints"`
+	}
+	if err := s.call(s.discoveryURL, "DescribeEndpoints", struct{}{}, &resp); err != nil {
+		return err
+	}
+	if len(resp.Endpoints) == 0 {
+		return xerrors.New("no endpoints returned")
+	}
+
+	u, err := url.Parse(s.discoveryURL)
+	if err != nil {
+		return xerrors.Errorf("url.Parse: %w", err)
+	}
+
+	endpoint := resp.Endpoints[0]
+	s.endpoint = u.Scheme + "://" + endpoint.Address
+	s.expires = time.Now().Add(time.Duration(endpoint.CachePeriodInMinutes) * time.Minute)
+	log.Debugf("timestream: using endpoint %s until %s", s.endpoint, s.expires)
+
+	return nil
+}
+
+// WritePoints writes the points' records in batches of at most
+// timestreamMaxRecords.
+func (s *TimestreamSink) WritePoints(pts []*write.Point) error {
+	if time.Now().After(s.expires) {
+		if err := s.discover(); err != nil {
+			return xerrors.Errorf("discover: %w", err)
+		}
+	}
+
+	records := timestreamRecords(pts)
+	for len(records) > 0 {
+		n := len(records)
+		if n > timestreamMaxRecords {
+			n = timestreamMaxRecords
+		}
+
+		req := struct {
+			DatabaseName string             `json:"DatabaseName"`
+			TableName    string             `json:"TableName"`
+			Records      []timestreamRecord `json:"Records"`
+		}{s.database, s.table, records[:n]}
+		if err := s.call(s.endpoint, "WriteRecords", req, nil); err != nil {
+			return err
+		}
+
+		records = records[n:]
+	}
+
+	return nil
+}
+
+func (s *TimestreamSink) Close() error {
+	return nil
+}
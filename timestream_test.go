@@ -0,0 +1,185 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// TestSignV4 checks signatures against the get-vanilla and post-vanilla
+// cases of the AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	date := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	cases := []struct {
+		Method string
+		Want   string
+	}{
+		{http.MethodGet, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{http.MethodPost, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Method, func(t *testing.T) {
+			req, err := http.NewRequest(c.Method, "https://example.amazonaws.com/", nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest: %+v", err)
+			}
+
+			signV4(req, nil, creds, "us-east-1", "service", date)
+			if got := req.Header.Get("Authorization"); got != c.Want {
+				t.Errorf("got  %s\nwant %s", got, c.Want)
+			}
+		})
+	}
+}
+
+// fakeTimestream records the WriteRecords requests it receives, answering
+// DescribeEndpoints with its own address.
+type fakeTimestream struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	targets []string
+	writes  [][]timestreamRecord
+	reject  bool
+}
+
+func newFakeTimestream(t *testing.T) *fakeTimestream {
+	f := &fakeTimestream{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/timestream/aws4_request") {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		if got := r.Header.Get("X-Amz-Security-Token"); got != "session" {
+			t.Errorf("X-Amz-Security-Token %q, want session", got)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		target := r.Header.Get("X-Amz-Target")
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.targets = append(f.targets, target)
+
+		switch target {
+		case "Timestream_20181101.DescribeEndpoints":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Endpoints": []map[string]interface{}{{"Address": r.Host, "CachePeriodInMinutes": 1440}},
+			})
+		case "Timestream_20181101.WriteRecords":
+			if f.reject {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"com.amazonaws.timestream.v20181101#RejectedRecordsException","message":"One or more records have been rejected.","RejectedRecords":[{"RecordIndex":0,"Reason":"The record timestamp is outside the time range of the data ingestion window."}]}`))
+				return
+			}
+
+			var req struct {
+				DatabaseName string
+				TableName    string
+				Records      []timestreamRecord
+			}
+			json.Unmarshal(body, &req)
+			if req.DatabaseName != "rtlamr" || req.TableName != "meters" {
+				t.Errorf("wrote to %s.%s, want rtlamr.meters", req.DatabaseName, req.TableName)
+			}
+			f.writes = append(f.writes, req.Records)
+			w.Write([]byte(`{"RecordsIngested":{"Total":1}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return f
+}
+
+func TestTimestreamSink(t *testing.T) {
+	f := newFakeTimestream(t)
+	defer f.Close()
+
+	creds := awsCredentials{"AKID", "secret", "session"}
+	sink, err := NewTimestreamSink("rtlamr", "meters", "us-east-1", f.URL, creds)
+	if err != nil {
+		t.Fatalf("NewTimestreamSink: %+v", err)
+	}
+	defer sink.Close()
+
+	// 75 points of 2 fields each are written as 100 and 50 records.
+	var pts []*write.Point
+	for i := 0; i < 75; i++ {
+		pts = append(pts, write.NewPoint(
+			"rtlamr",
+			map[string]string{"protocol": "R900", "endpoint_id": "5", "unit": ""},
+			map[string]interface{}{"consumption": int64(i), "leaking": i%2 == 0},
+			testTime,
+		))
+	}
+	if err := sink.WritePoints(pts); err != nil {
+		t.Fatalf("sink.WritePoints: %+v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	wantTargets := []string{"Timestream_20181101.DescribeEndpoints", "Timestream_20181101.WriteRecords", "Timestream_20181101.WriteRecords"}
+	if !reflect.DeepEqual(f.targets, wantTargets) {
+		t.Fatalf("got requests %v, want %v", f.targets, wantTargets)
+	}
+	if len(f.writes[0]) != 100 || len(f.writes[1]) != 50 {
+		t.Fatalf("got batches of %d and %d records, want 100 and 50", len(f.writes[0]), len(f.writes[1]))
+	}
+
+	dims := []timestreamDimension{{"measurement", "rtlamr"}, {"endpoint_id", "5"}, {"protocol", "R900"}}
+	want := []timestreamRecord{
+		{dims, "consumption", "0", "BIGINT", "1577872800000000000", "NANOSECONDS"},
+		{dims, "leaking", "true", "BOOLEAN", "1577872800000000000", "NANOSECONDS"},
+	}
+	if got := f.writes[0][:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestTimestreamSinkRejected(t *testing.T) {
+	f := newFakeTimestream(t)
+	defer f.Close()
+	f.reject = true
+
+	sink, err := NewTimestreamSink("rtlamr", "meters", "us-east-1", f.URL, awsCredentials{"AKID", "secret", "session"})
+	if err != nil {
+		t.Fatalf("NewTimestreamSink: %+v", err)
+	}
+	defer sink.Close()
+
+	pt := write.NewPoint("rtlamr", map[string]string{"protocol": "SCM"}, map[string]interface{}{"consumption": int64(1)}, testTime)
+	err = sink.WritePoints([]*write.Point{pt})
+	if err == nil || !strings.Contains(err.Error(), "RejectedRecordsException") || !strings.Contains(err.Error(), "ingestion window") {
+		t.Errorf("got error %v, want the rejected record's reason", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+// walBatchSize is the most points written to the next sink at once while
+// draining the log.
+const walBatchSize = 5000
+
+// WALSink stores points in a write-ahead log on disk and writes them to the
+// next sink in the background, removing them once written. Points survive
+// outages of the next sink and restarts of the collector, so are written at
+// least once. At most max points are kept, dropping the oldest.
+type WALSink struct {
+	next Sink
+	db   *bbolt.DB
+	max  int
+
+	mu    sync.Mutex
+	count int
+	line  bytes.Buffer
+	enc   *lp.Encoder
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWALSink opens the log in filename and writes any points left in it by
+// a previous run before returning. Points which can't be written yet remain
+// in the log and are retried in the background.
+func NewWALSink(next Sink, filename string, max int) (*WALSink, error) {
+	db, err := bbolt.Open(filename, 0600, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("bbolt.Open: %w", err)
+	}
+
+	s := &WALSink{
+		next: next,
+		db:   db,
+		max:  max,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.enc = lp.NewEncoder(&s.line)
+	s.enc.SetFieldTypeSupport(lp.UintSupport)
+	s.enc.FailOnFieldErr(true)
+	s.enc.SetPrecision(time.Nanosecond)
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte("points"))
+		if err != nil {
+			return xerrors.Errorf("tx.CreateBucketIfNotExists: %w", err)
+		}
+		s.count = bkt.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, xerrors.Errorf("db.Update: %w", err)
+	}
+
+	if s.count > 0 {
+		log.Printf("writing %d points left in %s", s.count, filename)
+		if err := s.drain(); err != nil {
+			log.Warnf("%+v", xerrors.Errorf("drain: %w", err))
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// WritePoints appends points to the log, to be written in the background.
+func (s *WALSink) WritePoints(pts []*write.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped int
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte("points"))
+		for _, pt := range pts {
+			s.line.Reset()
+			if _, err := s.enc.Encode(pt); err != nil {
+				return xerrors.Errorf("enc.Encode: %w", err)
+			}
+
+			seq, err := bkt.NextSequence()
+			if err != nil {
+				return xerrors.Errorf("bkt.NextSequence: %w", err)
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+
+			// Values must remain valid until the transaction commits.
+			if err := bkt.Put(key, append([]byte(nil), s.line.Bytes()...)); err != nil {
+				return xerrors.Errorf("bkt.Put: %w", err)
+			}
+		}
+
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil && s.count+len(pts)-dropped > s.max; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return xerrors.Errorf("c.Delete: %w", err)
+			}
+			dropped++
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("db.Update: %w", err)
+	}
+	s.count += len(pts) - dropped
+
+	if dropped > 0 {
+		log.Warnf("COLLECT_WAL_MAX reached, dropped %d oldest points", dropped)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ping passes through to the next sink, if it supports it.
+func (s *WALSink) Ping() error {
+	if pinger, ok := s.next.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// Close makes a last attempt to write the log, leaving anything still
+// unwritten for the next run, and closes the next sink.
+func (s *WALSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	if err := s.drain(); err != nil {
+		log.Warnf("%+v", xerrors.Errorf("drain: %w", err))
+	}
+	if s.count > 0 {
+		log.Warnf("%d points remain in %s", s.count, s.db.Path())
+	}
+
+	if err := s.db.Close(); err != nil {
+		return xerrors.Errorf("db.Close: %w", err)
+	}
+	return s.next.Close()
+}
+
+// run drains the log whenever points are added, backing off while the next
+// sink fails.
+func (s *WALSink) run() {
+	defer close(s.done)
+
+	backoff := time.Second
+	for {
+		if err := s.drain(); err != nil {
+			log.Warnf("%+v", xerrors.Errorf("drain: %w", err))
+			log.Warnf("%d points in write-ahead log, retrying in %s", s.Pending(), backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		select {
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Pending returns the number of points in the log.
+func (s *WALSink) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// drain writes the log to the next sink, oldest points first, until it is
+// empty or a write fails.
+func (s *WALSink) drain() error {
+	parser := lp.NewParser(lp.NewMetricHandler())
+
+	for {
+		var keys [][]byte
+		var pts []*write.Point
+
+		err := s.db.View(func(tx *bbolt.Tx) error {
+			c := tx.Bucket([]byte("points")).Cursor()
+			for k, v := c.First(); k != nil && len(keys) < walBatchSize; k, v = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+
+				// A corrupt entry would otherwise block the log forever.
+				metrics, err := parser.Parse(v)
+				if err != nil {
+					log.Warnf("%+v", xerrors.Errorf("dropping unreadable point: parser.Parse: %w", err))
+					continue
+				}
+				for _, m := range metrics {
+					pts = append(pts, metricPoint(m))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return xerrors.Errorf("db.View: %w", err)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if len(pts) > 0 {
+			if err := s.next.WritePoints(pts); err != nil {
+				return xerrors.Errorf("next.WritePoints: %w", err)
+			}
+		}
+
+		// Points may have been dropped to make room while being written.
+		s.mu.Lock()
+		var removed int
+		err = s.db.Update(func(tx *bbolt.Tx) error {
+			bkt := tx.Bucket([]byte("points"))
+			for _, k := range keys {
+				if bkt.Get(k) == nil {
+					continue
+				}
+				if err := bkt.Delete(k); err != nil {
+					return xerrors.Errorf("bkt.Delete: %w", err)
+				}
+				removed++
+			}
+			return nil
+		})
+		if err == nil {
+			s.count -= removed
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return xerrors.Errorf("db.Update: %w", err)
+		}
+	}
+}
+
+// metricPoint converts a parsed line back into a point.
+func metricPoint(m lp.Metric) *write.Point {
+	tags := map[string]string{}
+	for _, tag := range m.TagList() {
+		tags[tag.Key] = tag.Value
+	}
+	fields := map[string]interface{}{}
+	for _, field := range m.FieldList() {
+		fields[field.Key] = field.Value
+	}
+	return write.NewPoint(m.Name(), tags, fields, m.Time())
+}
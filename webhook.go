@@ -0,0 +1,160 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// webhookTimeout bounds each webhook request.
+const webhookTimeout = 10 * time.Second
+
+// alertStates returns whether each alert a message reports is active: leak and
+// backflow for R900, outage for IDM and NetIDM.
+func alertStates(msg Message) map[string]bool {
+	switch msg := msg.(type) {
+	case *R900:
+		return map[string]bool{
+			"leak":     msg.LeakNow > 0,
+			"backflow": msg.BackFlow > 0,
+		}
+	case *IDM:
+		return map[string]bool{
+			"outage": outageBit(msg.outageFlags(), 0),
+		}
+	}
+	return nil
+}
+
+// WebhookEvent is posted to the webhook when an alert starts or stops.
+type WebhookEvent struct {
+	EndpointID   uint32    `json:"endpoint_id"`
+	EndpointType uint8     `json:"endpoint_type"`
+	Protocol     string    `json:"protocol"`
+	Event        string    `json:"event"`
+	Active       bool      `json:"active"`
+	Time         time.Time `json:"time"`
+}
+
+// webhookKey identifies one of a meter's alerts.
+type webhookKey struct {
+	Meter
+	Event string
+}
+
+// Webhook posts an event to URL whenever one of a meter's alerts changes,
+// at most once per alert every Interval. A suppressed change is posted with
+// the first message after the interval, unless the alert changed back in the
+// meantime. Alert states are only kept in memory, so the first message from
+// each meter never triggers an event.
+type Webhook struct {
+	URL      string
+	Interval time.Duration
+
+	client *http.Client
+	// states are the last posted states of each meter's alerts.
+	states map[Meter]map[string]bool
+	sent   map[webhookKey]time.Time
+
+	// pending are posts in progress.
+	pending sync.WaitGroup
+}
+
+func NewWebhook(url string, interval time.Duration) *Webhook {
+	return &Webhook{
+		URL:      url,
+		Interval: interval,
+		client:   &http.Client{Timeout: webhookTimeout},
+		states:   map[Meter]map[string]bool{},
+		sent:     map[webhookKey]time.Time{},
+	}
+}
+
+// Notify posts an event for each of the meter's alert states which changed
+// since it was last posted. Events are posted in the background.
+func (w *Webhook) Notify(meter Meter, states map[string]bool, t time.Time) {
+	if len(states) == 0 {
+		return
+	}
+
+	prev, seen := w.states[meter]
+	if !seen {
+		w.states[meter] = states
+		return
+	}
+
+	for event, active := range states {
+		if prev[event] == active {
+			continue
+		}
+
+		key := webhookKey{meter, event}
+		if last, ok := w.sent[key]; ok && t.Sub(last) < w.Interval {
+			log.Debugf("webhook: suppressed %s event from %d (%s)", event, meter.EndpointID, meter.Protocol)
+			continue
+		}
+		w.sent[key] = t
+		prev[event] = active
+
+		w.pending.Add(1)
+		go func(evt WebhookEvent) {
+			defer w.pending.Done()
+			if err := w.post(evt); err != nil {
+				log.Warnf("webhook: %+v", err)
+			}
+		}(WebhookEvent{meter.EndpointID, meter.EndpointType, meter.Protocol, event, active, t})
+	}
+}
+
+// Wait waits for posts in progress to finish.
+func (w *Webhook) Wait() {
+	w.pending.Wait()
+}
+
+func (w *Webhook) post(evt WebhookEvent) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return xerrors.Errorf("json.Marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return xerrors.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return xerrors.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return xerrors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Data aggregation for rtlamr.
+// Copyright (C) 2017 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []WebhookEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evt WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+			t.Errorf("json.Decode: %+v", err)
+		}
+		mu.Lock()
+		events = append(events, evt)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, 5*time.Minute)
+	meter := Meter{EndpointID: 1, EndpointType: 163, Protocol: "R900"}
+
+	// notify sends a message and returns the events it posted.
+	notify := func(minutes int, leak, backflow bool) []WebhookEvent {
+		t.Helper()
+
+		mu.Lock()
+		events = nil
+		mu.Unlock()
+
+		w.Notify(meter, map[string]bool{"leak": leak, "backflow": backflow}, testTime.Add(time.Duration(minutes)*time.Minute))
+		w.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+
+	steps := []struct {
+		Name     string
+		Minutes  int
+		Leak     bool
+		Backflow bool
+		Want     map[string]bool
+	}{
+		{"first message", 0, false, false, map[string]bool{}},
+		{"leak starts", 1, true, false, map[string]bool{"leak": true}},
+		{"leak stops within interval", 2, false, false, map[string]bool{}},
+		{"backflow isn't limited by leak", 3, false, true, map[string]bool{"backflow": true}},
+		{"still within interval", 4, false, true, map[string]bool{}},
+		{"suppressed leak change", 7, false, true, map[string]bool{"leak": false}},
+		{"no change", 8, false, true, map[string]bool{}},
+	}
+
+	for _, step := range steps {
+		got := map[string]bool{}
+		for _, evt := range notify(step.Minutes, step.Leak, step.Backflow) {
+			got[evt.Event] = evt.Active
+		}
+		if !reflect.DeepEqual(got, step.Want) {
+			t.Errorf("%s: posted %v, want %v", step.Name, got, step.Want)
+		}
+	}
+}